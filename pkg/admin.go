@@ -0,0 +1,283 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// adminBodyLimit caps the size of admin request bodies
+const adminBodyLimit = 1 << 20
+
+// AdminAuthFunc authorizes a request to the admin API
+type AdminAuthFunc func(r *http.Request) bool
+
+// ClientInfo describes a connected client in the admin API
+type ClientInfo struct {
+	ID          string    `json:"id"`
+	UserID      string    `json:"user_id"`
+	RemoteAddr  string    `json:"remote_addr"`
+	ConnectedAt time.Time `json:"connected_at"`
+	Topics      []string  `json:"topics"`
+	BufferDepth int       `json:"buffer_depth"`
+}
+
+// TopicInfo describes a topic filter and its local subscriber count in the admin API
+type TopicInfo struct {
+	Topic       string `json:"topic"`
+	Subscribers int    `json:"subscribers"`
+}
+
+// adminTarget selects the connections an admin command applies to, either one
+// client by ID or every connection of a user
+type adminTarget struct {
+	ClientID string `json:"client_id"`
+	UserID   string `json:"user_id"`
+	Topic    string `json:"topic"`
+}
+
+// adminMessage is the body of the admin publish and broadcast commands
+type adminMessage struct {
+	Topic string `json:"topic"`
+	Data  string `json:"data"`
+}
+
+// AdminHandler returns an http.Handler with JSON endpoints for inspecting and managing
+// connections. Every request must pass auth, a nil auth rejects all requests. Mount it
+// with http.StripPrefix, e.g. under "/admin":
+//
+//	GET  /clients      lists the local clients
+//	GET  /topics       lists the topic filters with their subscriber counts
+//	POST /kick         closes a client ({"client_id"}) or a user's connections ({"user_id"})
+//	POST /unsubscribe  removes a subscription ({"client_id" or "user_id", "topic"})
+//	POST /publish      publishes to a topic ({"topic", "data"})
+//	POST /broadcast    broadcasts to all clients ({"data"})
+func (m *Manager) AdminHandler(auth AdminAuthFunc) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/clients", adminMethod(http.MethodGet, m.adminClients))
+	mux.HandleFunc("/topics", adminMethod(http.MethodGet, m.adminTopics))
+	mux.HandleFunc("/kick", adminMethod(http.MethodPost, m.adminKick))
+	mux.HandleFunc("/unsubscribe", adminMethod(http.MethodPost, m.adminUnsubscribe))
+	mux.HandleFunc("/publish", adminMethod(http.MethodPost, m.adminPublish))
+	mux.HandleFunc("/broadcast", adminMethod(http.MethodPost, m.adminBroadcast))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth == nil || !auth(r) {
+			writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// GetClients gets the clients connected to this node
+func (m *Manager) GetClients() []ClientInfo {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	clients := make([]ClientInfo, 0, len(m.Clients))
+	for client := range m.Clients {
+		topics := make([]string, 0, len(client.topics))
+		for topic := range client.topics {
+			topics = append(topics, topic)
+		}
+		sort.Strings(topics)
+		clients = append(clients, ClientInfo{
+			ID:          client.id,
+			UserID:      client.userID,
+			RemoteAddr:  client.conn.RemoteAddr().String(),
+			ConnectedAt: client.connectedAt,
+			Topics:      topics,
+			BufferDepth: client.SendBufferDepth(),
+		})
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].ConnectedAt.Before(clients[j].ConnectedAt)
+	})
+	return clients
+}
+
+// GetTopics gets the topic filters with local subscribers and their subscriber counts
+func (m *Manager) GetTopics() []TopicInfo {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	topics := make([]TopicInfo, 0, len(m.Topics))
+	for topic, clients := range m.Topics {
+		if len(clients) > 0 {
+			topics = append(topics, TopicInfo{Topic: topic, Subscribers: len(clients)})
+		}
+	}
+	sort.Slice(topics, func(i, j int) bool {
+		return topics[i].Topic < topics[j].Topic
+	})
+	return topics
+}
+
+// KickClient closes the connection of a local client by its ID
+func (m *Manager) KickClient(clientID string) bool {
+	client := m.clientByID(clientID)
+	if client == nil {
+		return false
+	}
+	client.setLeaveReason(disconnectKicked)
+	client.conn.Close()
+	return true
+}
+
+// UnsubscribeClient removes a local client's subscription to a topic filter,
+// the client is notified with an "unsubscribed" frame
+func (m *Manager) UnsubscribeClient(clientID, topic string) bool {
+	client := m.clientByID(clientID)
+	if client == nil {
+		return false
+	}
+	m.Unsubscribe <- &Subscription{client: client, topic: topic, cmd: &Envelope{Topic: topic}}
+	return true
+}
+
+// clientByID finds a local client by its ID
+func (m *Manager) clientByID(clientID string) *Client {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for client := range m.Clients {
+		if client.id == clientID {
+			return client
+		}
+	}
+	return nil
+}
+
+// userClientIDs gets the IDs of a user's local connections
+func (m *Manager) userClientIDs(userID string) []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	ids := make([]string, 0, len(m.users[userID]))
+	for client := range m.users[userID] {
+		ids = append(ids, client.id)
+	}
+	return ids
+}
+
+func (m *Manager) adminClients(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{"clients": m.GetClients()})
+}
+
+func (m *Manager) adminTopics(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{"topics": m.GetTopics()})
+}
+
+func (m *Manager) adminKick(w http.ResponseWriter, r *http.Request) {
+	var target adminTarget
+	if !readJSON(w, r, &target) {
+		return
+	}
+
+	var ok bool
+	switch {
+	case target.ClientID != "":
+		ok = m.KickClient(target.ClientID)
+	case target.UserID != "":
+		ok = m.CloseClient(target.UserID)
+	default:
+		writeJSONError(w, http.StatusBadRequest, "client_id or user_id is required")
+		return
+	}
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "client not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"ok": true})
+}
+
+func (m *Manager) adminUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	var target adminTarget
+	if !readJSON(w, r, &target) {
+		return
+	}
+	if target.Topic == "" {
+		writeJSONError(w, http.StatusBadRequest, "topic is required")
+		return
+	}
+
+	var ids []string
+	switch {
+	case target.ClientID != "":
+		ids = []string{target.ClientID}
+	case target.UserID != "":
+		ids = m.userClientIDs(target.UserID)
+	default:
+		writeJSONError(w, http.StatusBadRequest, "client_id or user_id is required")
+		return
+	}
+
+	unsubscribed := 0
+	for _, id := range ids {
+		if m.UnsubscribeClient(id, target.Topic) {
+			unsubscribed++
+		}
+	}
+	if unsubscribed == 0 {
+		writeJSONError(w, http.StatusNotFound, "client not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"clients": unsubscribed})
+}
+
+func (m *Manager) adminPublish(w http.ResponseWriter, r *http.Request) {
+	var msg adminMessage
+	if !readJSON(w, r, &msg) {
+		return
+	}
+	if !validTopicName(msg.Topic) {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid topic %q", msg.Topic))
+		return
+	}
+	m.BroadcastTopicMessageContext(r.Context(), msg.Topic, msg.Data)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"ok": true})
+}
+
+func (m *Manager) adminBroadcast(w http.ResponseWriter, r *http.Request) {
+	var msg adminMessage
+	if !readJSON(w, r, &msg) {
+		return
+	}
+	m.BroadcastMessage([]byte(msg.Data), nil)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"ok": true})
+}
+
+// adminMethod rejects requests with any other method than the given one
+func adminMethod(method string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// readJSON decodes a size-limited JSON request body, answering 400 if it is invalid
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	err := json.NewDecoder(io.LimitReader(r.Body, adminBodyLimit)).Decode(v)
+	if err != nil && !errors.Is(err, io.EOF) {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid JSON body: %v", err))
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,184 @@
+package pkg
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// adminAuth accepts requests carrying the admin token
+func adminAuth(r *http.Request) bool {
+	return r.Header.Get("X-Admin-Token") == "secret"
+}
+
+func adminRequest(t *testing.T, handler http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("X-Admin-Token", "secret")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+// adminClients connects the users and waits until they are registered
+func adminClients(t *testing.T, m *Manager, url string, userIDs ...string) []*websocket.Conn {
+	t.Helper()
+	conns := make([]*websocket.Conn, len(userIDs))
+	for i, userID := range userIDs {
+		conns[i] = dialLegacy(t, url+"?user_id="+userID)
+	}
+	for m.GetClientCount() < len(userIDs) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	return conns
+}
+
+// clientIDOf finds the ID of a user's first connection
+func clientIDOf(t *testing.T, m *Manager, userID string) string {
+	t.Helper()
+	for _, client := range m.GetClients() {
+		if client.UserID == userID {
+			return client.ID
+		}
+	}
+	t.Fatalf("no client of %s", userID)
+	return ""
+}
+
+// expectClosed reads until the server closes the connection
+func expectClosed(t *testing.T, conn *websocket.Conn) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if netErr, ok := err.(interface{ Timeout() bool }); ok && netErr.Timeout() {
+				t.Fatal("connection was not closed")
+			}
+			return
+		}
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	m := NewManager()
+	for _, tc := range []struct {
+		name   string
+		auth   AdminAuthFunc
+		token  string
+		status int
+	}{
+		{"nil hook", nil, "secret", http.StatusUnauthorized},
+		{"wrong token", adminAuth, "guess", http.StatusUnauthorized},
+		{"no token", adminAuth, "", http.StatusUnauthorized},
+		{"valid token", adminAuth, "secret", http.StatusOK},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/clients", nil)
+		if tc.token != "" {
+			r.Header.Set("X-Admin-Token", tc.token)
+		}
+		w := httptest.NewRecorder()
+		m.AdminHandler(tc.auth).ServeHTTP(w, r)
+		if w.Code != tc.status {
+			t.Errorf("%s: answered %d, want %d", tc.name, w.Code, tc.status)
+		}
+	}
+}
+
+func TestAdminMethods(t *testing.T) {
+	handler := NewManager().AdminHandler(adminAuth)
+	for _, tc := range []struct {
+		method, path, allow string
+	}{
+		{http.MethodPost, "/clients", http.MethodGet},
+		{http.MethodDelete, "/topics", http.MethodGet},
+		{http.MethodGet, "/kick", http.MethodPost},
+		{http.MethodGet, "/unsubscribe", http.MethodPost},
+		{http.MethodPut, "/publish", http.MethodPost},
+		{http.MethodGet, "/broadcast", http.MethodPost},
+	} {
+		w := adminRequest(t, handler, tc.method, tc.path, "")
+		if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != tc.allow {
+			t.Errorf("%s %s answered %d with Allow %q, want 405 with %q", tc.method, tc.path, w.Code, w.Header().Get("Allow"), tc.allow)
+		}
+	}
+}
+
+func TestAdminKick(t *testing.T) {
+	m, _, url := startTestManager(t)
+	handler := m.AdminHandler(adminAuth)
+	conns := adminClients(t, m, url, "alice", "alice", "bob")
+
+	for _, tc := range []struct {
+		name, body string
+		status     int
+	}{
+		{"unknown client", `{"client_id":"missing"}`, http.StatusNotFound},
+		{"unknown user", `{"user_id":"mallory"}`, http.StatusNotFound},
+		{"no target", `{}`, http.StatusBadRequest},
+		{"invalid JSON", `{`, http.StatusBadRequest},
+	} {
+		if w := adminRequest(t, handler, http.MethodPost, "/kick", tc.body); w.Code != tc.status {
+			t.Errorf("%s: answered %d %s, want %d", tc.name, w.Code, w.Body, tc.status)
+		}
+	}
+
+	if w := adminRequest(t, handler, http.MethodPost, "/kick", `{"client_id":"`+clientIDOf(t, m, "bob")+`"}`); w.Code != http.StatusOK {
+		t.Fatalf("kick by client ID answered %d %s", w.Code, w.Body)
+	}
+	expectClosed(t, conns[2])
+
+	if w := adminRequest(t, handler, http.MethodPost, "/kick", `{"user_id":"alice"}`); w.Code != http.StatusOK {
+		t.Fatalf("kick by user ID answered %d %s", w.Code, w.Body)
+	}
+	expectClosed(t, conns[0])
+	expectClosed(t, conns[1])
+}
+
+func TestAdminUnsubscribe(t *testing.T) {
+	m, _, url := startTestManager(t)
+	handler := m.AdminHandler(adminAuth)
+	conns := adminClients(t, m, url, "alice", "alice", "bob")
+	for _, conn := range conns {
+		subscribeTest(t, conn, "news")
+	}
+
+	for _, tc := range []struct {
+		name, body string
+		status     int
+	}{
+		{"unknown client", `{"client_id":"missing","topic":"news"}`, http.StatusNotFound},
+		{"unknown user", `{"user_id":"mallory","topic":"news"}`, http.StatusNotFound},
+		{"no topic", `{"user_id":"alice"}`, http.StatusBadRequest},
+		{"no target", `{"topic":"news"}`, http.StatusBadRequest},
+	} {
+		if w := adminRequest(t, handler, http.MethodPost, "/unsubscribe", tc.body); w.Code != tc.status {
+			t.Errorf("%s: answered %d %s, want %d", tc.name, w.Code, w.Body, tc.status)
+		}
+	}
+
+	var result struct{ Clients int }
+	w := adminRequest(t, handler, http.MethodPost, "/unsubscribe", `{"user_id":"alice","topic":"news"}`)
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &result) != nil || result.Clients != 2 {
+		t.Fatalf("unsubscribe by user ID answered %d %s, want 2 clients", w.Code, w.Body)
+	}
+	for _, conn := range conns[:2] {
+		readFrame(t, conn, func(frame map[string]interface{}) bool { return frame["op"] == OpUnsubscribed })
+	}
+	if topics := m.GetTopics(); len(topics) != 1 || topics[0].Subscribers != 1 {
+		t.Fatalf("topics after unsubscribing alice: %+v, want news with bob only", topics)
+	}
+
+	w = adminRequest(t, handler, http.MethodPost, "/unsubscribe", `{"client_id":"`+clientIDOf(t, m, "bob")+`","topic":"news"}`)
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &result) != nil || result.Clients != 1 {
+		t.Fatalf("unsubscribe by client ID answered %d %s, want 1 client", w.Code, w.Body)
+	}
+	readFrame(t, conns[2], func(frame map[string]interface{}) bool { return frame["op"] == OpUnsubscribed })
+	if topics := m.GetTopics(); len(topics) != 0 {
+		t.Fatalf("topics after unsubscribing everyone: %+v", topics)
+	}
+}
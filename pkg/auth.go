@@ -0,0 +1,187 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Principal is the authenticated identity of a connection
+type Principal struct {
+	UserID    string                 `json:"user_id"`
+	Roles     []string               `json:"roles,omitempty"`
+	Claims    map[string]interface{} `json:"claims,omitempty"`
+	ExpiresAt time.Time              `json:"expires_at,omitempty"` // The connection is closed at expiry unless refreshed
+}
+
+// HasRole reports whether the principal has a role
+func (p *Principal) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator authenticates the upgrade request of a connection.
+// Returning an *AuthError rejects the request with its HTTP status.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// TokenAuthenticator is an Authenticator that can also verify a bare token,
+// which lets clients refresh an expiring principal with the "refresh" command
+type TokenAuthenticator interface {
+	Authenticator
+	AuthenticateToken(token string) (*Principal, error)
+}
+
+// CloseTokenExpired is the close code sent when a principal expires without being refreshed
+const CloseTokenExpired = 4001
+
+// AuthenticatorFunc adapts a function to the Authenticator interface
+type AuthenticatorFunc func(r *http.Request) (*Principal, error)
+
+// Authenticate calls f(r)
+func (f AuthenticatorFunc) Authenticate(r *http.Request) (*Principal, error) {
+	return f(r)
+}
+
+// AuthError rejects an upgrade request with an HTTP status
+type AuthError struct {
+	Status  int
+	Message string
+}
+
+// Error returns the rejection message
+func (e *AuthError) Error() string {
+	return e.Message
+}
+
+// NewAuthError creates an AuthError, an empty message defaults to the status text
+func NewAuthError(status int, message string) *AuthError {
+	if message == "" {
+		message = http.StatusText(status)
+	}
+	return &AuthError{Status: status, Message: message}
+}
+
+// SetAuthenticator authenticates connections, the client's user ID comes from the
+// returned Principal instead of the user_id query parameter
+func (m *Manager) SetAuthenticator(authenticator Authenticator) {
+	m.authenticator = authenticator
+}
+
+// EnableAuth enables authentication using the provided function.
+// The user_id query parameter is trusted, use SetAuthenticator to take the identity from the request.
+func (m *Manager) EnableAuth(authFunc func(r *http.Request) bool) {
+	m.authenticator = AuthenticatorFunc(func(r *http.Request) (*Principal, error) {
+		if !authFunc(r) {
+			return nil, NewAuthError(http.StatusUnauthorized, "")
+		}
+		return &Principal{UserID: r.URL.Query().Get("user_id")}, nil
+	})
+}
+
+// DisableAuth disables authentication
+func (m *Manager) DisableAuth() {
+	m.authenticator = nil
+}
+
+// authenticate runs the authenticator and writes the HTTP error on failure.
+// Without an authenticator the principal is nil and the user_id query parameter is used.
+func (m *Manager) authenticate(w http.ResponseWriter, r *http.Request) (*Principal, bool) {
+	if m.authenticator == nil {
+		return nil, true
+	}
+
+	principal, err := m.authenticator.Authenticate(r)
+	if err == nil && principal == nil {
+		err = NewAuthError(http.StatusUnauthorized, "")
+	}
+	if err != nil {
+		status := http.StatusUnauthorized
+		var authErr *AuthError
+		if errors.As(err, &authErr) && authErr.Status != 0 {
+			status = authErr.Status
+		}
+		http.Error(w, http.StatusText(status), status)
+		m.reportError(&ErrorEvent{
+			Message: fmt.Sprintf("Authentication failed: %v", err),
+			Code:    1007,
+			Time:    time.Now(),
+		})
+		return nil, false
+	}
+	return principal, true
+}
+
+// Principal returns the authenticated identity of the client. Without an
+// authenticator it only carries the user ID from the query parameter.
+func (c *Client) Principal() *Principal {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+	return c.principal
+}
+
+// scheduleExpiry closes the connection when the principal expires
+func (c *Client) scheduleExpiry() {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+	if c.expiry != nil {
+		c.expiry.Stop()
+		c.expiry = nil
+	}
+	if c.principal.ExpiresAt.IsZero() {
+		return
+	}
+
+	c.expiry = time.AfterFunc(time.Until(c.principal.ExpiresAt), func() {
+		c.manager.reportError(&ErrorEvent{
+			Client:  c,
+			Message: "Token expired",
+			Code:    1014,
+			Time:    time.Now(),
+		})
+		c.setLeaveReason(disconnectTokenExpired)
+		c.disconnect(CloseTokenExpired, "token expired")
+	})
+}
+
+// stopExpiry cancels the expiry timer of a disconnected client
+func (c *Client) stopExpiry() {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+	if c.expiry != nil {
+		c.expiry.Stop()
+		c.expiry = nil
+	}
+}
+
+// refreshToken replaces the principal with the one of a fresh token for the same user
+func (c *Client) refreshToken(env *Envelope) {
+	authenticator, ok := c.manager.authenticator.(TokenAuthenticator)
+	if !ok {
+		c.replyError(env, 1008, "Token refresh is not supported")
+		return
+	}
+
+	principal, err := authenticator.AuthenticateToken(env.Token)
+	if err != nil {
+		c.replyError(env, 1007, fmt.Sprintf("Token refresh failed: %v", err))
+		return
+	}
+	if principal.UserID != c.userID {
+		c.replyError(env, 1007, "Token refresh failed: user mismatch")
+		return
+	}
+
+	c.authMu.Lock()
+	c.principal = principal
+	c.authMu.Unlock()
+	c.scheduleExpiry()
+	c.manager.debugLog("Token refreshed", c.logArgs("expires_at", principal.ExpiresAt)...)
+	c.reply(env, OpRefreshed)
+}
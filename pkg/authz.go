@@ -0,0 +1,178 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Authorization actions
+const (
+	ActionSubscribe = "subscribe"
+	ActionPublish   = "publish"
+	ActionBroadcast = "broadcast" // Legacy plain-text broadcast to every client, the topic is empty
+)
+
+// ErrForbidden is returned by authorizers that deny an action
+var ErrForbidden = errors.New("forbidden")
+
+// Authorizer decides whether a client may subscribe to a topic filter or publish on a topic.
+// It is called from the manager's event loop and must not block.
+type Authorizer interface {
+	Authorize(principal *Principal, action, topic string) error
+}
+
+// AuthorizerFunc adapts a function to the Authorizer interface
+type AuthorizerFunc func(principal *Principal, action, topic string) error
+
+// Authorize calls f(principal, action, topic)
+func (f AuthorizerFunc) Authorize(principal *Principal, action, topic string) error {
+	return f(principal, action, topic)
+}
+
+// TopicRule allows or denies actions on topics matching a pattern
+type TopicRule struct {
+	Roles   []string // Roles the rule applies to, empty applies to everyone
+	Actions []string // Actions the rule applies to, empty applies to all
+	Pattern string   // Topic filter with "+" and "#" wildcards
+	Allow   bool
+}
+
+// RuleAuthorizer evaluates rules in order and the first matching rule decides.
+// An allow rule must cover every topic a subscription filter can match,
+// a deny rule applies as soon as the filter overlaps its pattern.
+type RuleAuthorizer struct {
+	Rules        []TopicRule
+	DefaultAllow bool // Decision when no rule matches
+}
+
+// Authorize applies the rules to a request
+func (a *RuleAuthorizer) Authorize(principal *Principal, action, topic string) error {
+	for _, rule := range a.Rules {
+		if !rule.appliesTo(principal, action) {
+			continue
+		}
+		if rule.Allow && topicFilterCovers(rule.Pattern, topic) {
+			return nil
+		}
+		if !rule.Allow && topicFiltersOverlap(rule.Pattern, topic) {
+			return ErrForbidden
+		}
+	}
+	if a.DefaultAllow {
+		return nil
+	}
+	return ErrForbidden
+}
+
+func (r *TopicRule) appliesTo(principal *Principal, action string) bool {
+	if len(r.Actions) > 0 && !containsString(r.Actions, action) {
+		return false
+	}
+	if len(r.Roles) == 0 {
+		return true
+	}
+	for _, role := range r.Roles {
+		if principal != nil && principal.HasRole(role) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// topicFilterCovers reports whether every topic matched by filter is matched by pattern
+func topicFilterCovers(pattern, filter string) bool {
+	patternLevels := strings.Split(pattern, topicSeparator)
+	filterLevels := strings.Split(filter, topicSeparator)
+	for i, level := range patternLevels {
+		if level == multiLevelWildcard {
+			return true
+		}
+		if i >= len(filterLevels) || filterLevels[i] == multiLevelWildcard {
+			return false
+		}
+		if level != singleLevelWildcard && level != filterLevels[i] {
+			return false
+		}
+	}
+	return len(patternLevels) == len(filterLevels)
+}
+
+// topicFiltersOverlap reports whether some topic is matched by both filters
+func topicFiltersOverlap(a, b string) bool {
+	aLevels := strings.Split(a, topicSeparator)
+	bLevels := strings.Split(b, topicSeparator)
+	i := 0
+	for ; i < len(aLevels) && i < len(bLevels); i++ {
+		if aLevels[i] == multiLevelWildcard || bLevels[i] == multiLevelWildcard {
+			return true
+		}
+		if aLevels[i] == singleLevelWildcard || bLevels[i] == singleLevelWildcard {
+			continue
+		}
+		if aLevels[i] != bLevels[i] {
+			return false
+		}
+	}
+	// "#" also matches the parent level
+	switch {
+	case len(aLevels) == len(bLevels):
+		return true
+	case len(aLevels) > len(bLevels):
+		return len(aLevels) == i+1 && aLevels[i] == multiLevelWildcard
+	default:
+		return len(bLevels) == i+1 && bLevels[i] == multiLevelWildcard
+	}
+}
+
+// SetAuthorizer checks subscriptions, client publishes and legacy broadcasts, nil allows everything
+func (m *Manager) SetAuthorizer(authorizer Authorizer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.authorizer = authorizer
+}
+
+// authorize asks the authorizer whether the client may act on a topic
+func (m *Manager) authorize(client *Client, action, topic string) error {
+	m.mutex.Lock()
+	authorizer := m.authorizer
+	m.mutex.Unlock()
+	return m.authorizeWith(authorizer, client, action, topic)
+}
+
+// authorizeWith runs an authorizer without taking the mutex
+func (m *Manager) authorizeWith(authorizer Authorizer, client *Client, action, topic string) error {
+	if authorizer == nil {
+		return nil
+	}
+	if err := authorizer.Authorize(client.Principal(), action, topic); err != nil {
+		m.debugLog("Not authorized", client.logArgs("action", action, "topic", topic, "error", err)...)
+		return err
+	}
+	return nil
+}
+
+// denyMessage formats the error reported for a denied action
+func denyMessage(action, topic string, err error) string {
+	return fmt.Sprintf("Not authorized to %s %q: %v", action, topic, err)
+}
+
+// reportDenied reports a denied restore of a session subscription
+func (m *Manager) reportDenied(client *Client, action, topic string, err error) {
+	m.reportError(&ErrorEvent{
+		Client:  client,
+		Message: denyMessage(action, topic, err),
+		Code:    1015,
+		Time:    time.Now(),
+	})
+}
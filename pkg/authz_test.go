@@ -0,0 +1,206 @@
+package pkg
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialLegacy connects a client and reads its plain-text welcome
+func dialLegacy(t *testing.T, url string) *websocket.Conn {
+	t.Helper()
+	conn := dialTest(t, url)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := conn.ReadMessage(); err != nil {
+		t.Fatalf("read welcome: %v", err)
+	}
+	return conn
+}
+
+func TestLegacyBroadcastAuthorization(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		configure func(m *Manager, actions chan string)
+		delivered bool
+	}{
+		{"default", func(m *Manager, actions chan string) {}, true},
+		{"denied", func(m *Manager, actions chan string) {
+			m.SetAuthorizer(AuthorizerFunc(func(principal *Principal, action, topic string) error {
+				actions <- action + ":" + topic
+				return ErrForbidden
+			}))
+		}, false},
+		{"publish disabled", func(m *Manager, actions chan string) { m.DisableClientPublish() }, false},
+		{"publish enabled", func(m *Manager, actions chan string) { m.EnableClientPublish() }, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m, _, url := startTestManager(t)
+			actions := make(chan string, 1)
+			tc.configure(m, actions)
+			sender := dialLegacy(t, url)
+			receiver := dialLegacy(t, url)
+			for m.GetClientCount() < 2 {
+				time.Sleep(5 * time.Millisecond)
+			}
+
+			sender.WriteMessage(websocket.TextMessage, []byte("hello"))
+			// The marker follows the broadcast, if the broadcast was delivered
+			time.Sleep(50 * time.Millisecond)
+			m.BroadcastMessage([]byte("marker"), nil)
+
+			_, message, err := receiver.ReadMessage()
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if got := string(message) == "hello"; got != tc.delivered {
+				t.Fatalf("received %q first, broadcast delivered %v, want %v", message, got, tc.delivered)
+			}
+			if tc.name == "denied" {
+				select {
+				case action := <-actions:
+					if action != ActionBroadcast+":" {
+						t.Fatalf("authorizer saw %q, want a broadcast with an empty topic", action)
+					}
+				default:
+					t.Fatal("authorizer was not asked")
+				}
+			}
+		})
+	}
+}
+
+func TestLegacyJSONWithUnknownOpIsBroadcast(t *testing.T) {
+	m, _, url := startTestManager(t)
+	sender := dialLegacy(t, url)
+	receiver := dialLegacy(t, url)
+	for m.GetClientCount() < 2 {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	sender.WriteMessage(websocket.TextMessage, []byte(`{"op":"move","x":1}`))
+	_, message, err := receiver.ReadMessage()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(message) != `{"op":"move","x":1}` {
+		t.Fatalf("receiver got %q, want the broadcast", message)
+	}
+
+	// With a version the envelope is a command and the op is rejected
+	sender.WriteMessage(websocket.TextMessage, []byte(`{"v":1,"op":"move","id":"1"}`))
+	frame := readFrame(t, sender, func(frame map[string]interface{}) bool { return frame["op"] == OpError })
+	if frame["code"] != float64(1008) {
+		t.Fatalf("versioned unknown op answered %v, want code 1008", frame)
+	}
+}
+
+func TestTopicFilterCovers(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, filter string
+		want            bool
+	}{
+		{"game/room1", "game/room1", true},
+		{"game/+", "game/room1", true},
+		{"game/+", "game/+", true},
+		{"game/#", "game/room1/score", true},
+		{"game/#", "game/#", true},
+		// "#" also matches its parent level
+		{"game/#", "game", true},
+		{"#", "+", true},
+		{"#", "#", true},
+		{"+/+", "game/+", true},
+		{"game/room1", "game/+", false},
+		{"game/+", "game/#", false},
+		{"+", "#", false},
+		{"game/+", "game", false},
+		{"game/+", "game/room1/score", false},
+		{"game", "game/#", false},
+		{"chat/#", "game/room1", false},
+	} {
+		if got := topicFilterCovers(tc.pattern, tc.filter); got != tc.want {
+			t.Errorf("topicFilterCovers(%q, %q) = %v, want %v", tc.pattern, tc.filter, got, tc.want)
+		}
+	}
+}
+
+func TestTopicFiltersOverlap(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want bool
+	}{
+		{"game/room1", "game/room1", true},
+		{"game/+", "+/room1", true},
+		{"game/+/score", "game/#", true},
+		// "#" also matches its parent level
+		{"game/#", "game", true},
+		{"game", "game/#", true},
+		{"+", "#", true},
+		{"#", "game/room1", true},
+		{"game/room1", "game/room2", false},
+		{"game/+", "chat/+", false},
+		{"+", "game/room1", false},
+		{"game", "game/room1", false},
+		{"game/#", "chat", false},
+		{"game/+/#", "game", false},
+	} {
+		if got := topicFiltersOverlap(tc.a, tc.b); got != tc.want {
+			t.Errorf("topicFiltersOverlap(%q, %q) = %v, want %v", tc.a, tc.b, got, tc.want)
+		}
+		if got := topicFiltersOverlap(tc.b, tc.a); got != tc.want {
+			t.Errorf("topicFiltersOverlap(%q, %q) = %v, want %v", tc.b, tc.a, got, tc.want)
+		}
+	}
+}
+
+func TestRuleAuthorizer(t *testing.T) {
+	auth := &RuleAuthorizer{Rules: []TopicRule{
+		{Pattern: "game/+", Allow: true},
+		{Pattern: "game/secret/#", Allow: false},
+		{Pattern: "game/#", Allow: true},
+		{Roles: []string{"admin"}, Actions: []string{ActionSubscribe}, Pattern: "admin/#", Allow: true},
+		{Roles: []string{"editor", "admin"}, Actions: []string{ActionPublish}, Pattern: "news/#", Allow: true},
+	}}
+	user := &Principal{UserID: "u1"}
+	admin := &Principal{UserID: "a1", Roles: []string{"admin"}}
+	editor := &Principal{UserID: "e1", Roles: []string{"editor"}}
+
+	for _, tc := range []struct {
+		name      string
+		principal *Principal
+		action    string
+		topic     string
+		allowed   bool
+	}{
+		{"allow rule", user, ActionSubscribe, "game/room1", true},
+		// The first matching rule decides, so the earlier allow wins over the overlapping deny
+		{"allow before deny", user, ActionSubscribe, "game/secret", true},
+		{"deny after allow", user, ActionSubscribe, "game/secret/plans", false},
+		{"deny overlapping a filter", user, ActionSubscribe, "game/#", false},
+		{"allow after deny", user, ActionSubscribe, "game/room1/score", true},
+		{"no matching rule", user, ActionSubscribe, "chat", false},
+		{"role allowed", admin, ActionSubscribe, "admin/logs", true},
+		{"role missing", user, ActionSubscribe, "admin/logs", false},
+		{"anonymous", nil, ActionSubscribe, "admin/logs", false},
+		{"action not covered", admin, ActionPublish, "admin/logs", false},
+		{"one of several roles", editor, ActionPublish, "news/today", true},
+		{"role with other action", editor, ActionSubscribe, "news/today", false},
+		{"rule for all actions", editor, ActionPublish, "game/room1", true},
+	} {
+		err := auth.Authorize(tc.principal, tc.action, tc.topic)
+		if (err == nil) != tc.allowed {
+			t.Errorf("%s: Authorize(%s %q) = %v, allowed %v", tc.name, tc.action, tc.topic, err, tc.allowed)
+		}
+		if err != nil && err != ErrForbidden {
+			t.Errorf("%s: denied with %v, want ErrForbidden", tc.name, err)
+		}
+	}
+
+	auth.DefaultAllow = true
+	if err := auth.Authorize(user, ActionSubscribe, "chat"); err != nil {
+		t.Errorf("DefaultAllow denied a topic without rules: %v", err)
+	}
+	if err := auth.Authorize(user, ActionSubscribe, "game/secret/plans"); err != ErrForbidden {
+		t.Errorf("DefaultAllow overrode a deny rule: %v", err)
+	}
+}
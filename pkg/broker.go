@@ -0,0 +1,225 @@
+package pkg
+
+import (
+	"fmt"
+	"time"
+)
+
+// Broker message kinds
+const (
+	BrokerTopic     = "topic"
+	BrokerBroadcast = "broadcast"
+	BrokerUser      = "user"
+	BrokerClose     = "close" // Closes a user's connections
+)
+
+// BrokerMessage is relayed between the nodes of a cluster
+type BrokerMessage struct {
+	ID      string         `json:"id"` // Unique per message, used to drop duplicate deliveries
+	Kind    string         `json:"kind"`
+	NodeID  string         `json:"node_id"` // Publishing node, used to suppress echoes
+	Topic   string         `json:"topic,omitempty"`
+	UserID  string         `json:"user_id,omitempty"`
+	Message *TopicResponse `json:"message,omitempty"` // Topic message for BrokerTopic
+	Data    []byte         `json:"data,omitempty"`    // Raw payload for BrokerBroadcast and BrokerUser
+}
+
+// Broker fans messages out to every node of a cluster
+type Broker interface {
+	// Start connects the broker, handler receives the messages published by all nodes
+	Start(nodeID string, handler func(msg *BrokerMessage)) error
+	// Publish sends a message to all nodes
+	Publish(msg *BrokerMessage) error
+	// Subscribe is called when the first local subscriber of a topic filter appears
+	Subscribe(filter string) error
+	// Unsubscribe is called when the last local subscriber of a topic filter leaves
+	Unsubscribe(filter string) error
+	Close() error
+}
+
+// HistoryBroker is a Broker that persists topic messages. It assigns cluster-wide
+// sequence numbers and replays from its store, so history survives node restarts.
+type HistoryBroker interface {
+	Broker
+	// History returns the stored messages of topics matching filter, oldest first,
+	// published after sinceSeq and at/after since. Zero values disable the bounds.
+	History(filter string, sinceSeq uint64, since time.Time) ([]*TopicResponse, error)
+}
+
+// brokerSeenSize is the number of broker message IDs remembered for deduplication
+const brokerSeenSize = 1024
+
+// SetNodeID sets the ID of this node in the cluster, it must be called before SetBroker
+func (m *Manager) SetNodeID(nodeID string) {
+	m.nodeID = nodeID
+}
+
+// NodeID gets the ID of this node in the cluster
+func (m *Manager) NodeID() string {
+	return m.nodeID
+}
+
+// SetBroker connects the manager to a cluster broker
+func (m *Manager) SetBroker(broker Broker) error {
+	if err := broker.Start(m.nodeID, m.handleBrokerMessage); err != nil {
+		return fmt.Errorf("start broker: %w", err)
+	}
+
+	// Subscribe through the cluster queue so later interest changes apply after these
+	var err error
+	done := make(chan struct{})
+	m.mutex.Lock()
+	m.broker = broker
+	filters := make([]string, 0, len(m.interest))
+	for filter := range m.interest {
+		filters = append(filters, filter)
+	}
+	m.queueCluster(func() {
+		defer close(done)
+		for _, filter := range filters {
+			if subErr := broker.Subscribe(filter); subErr != nil {
+				err = fmt.Errorf("subscribe %s: %w", filter, subErr)
+				return
+			}
+		}
+	})
+	m.mutex.Unlock()
+	<-done
+	return err
+}
+
+// publishToBroker relays a message to the other nodes if a broker is set
+func (m *Manager) publishToBroker(msg *BrokerMessage) {
+	m.mutex.Lock()
+	broker := m.broker
+	m.mutex.Unlock()
+	if broker == nil {
+		return
+	}
+
+	msg.NodeID = m.nodeID
+	if msg.ID == "" {
+		msg.ID = randomID(8)
+	}
+	if err := broker.Publish(msg); err != nil {
+		m.reportError(&ErrorEvent{
+			Message: fmt.Sprintf("Broker publish failed: %v", err),
+			Code:    1013,
+			Time:    time.Now(),
+		}, "kind", msg.Kind, "topic", msg.Topic)
+	}
+}
+
+// handleBrokerMessage delivers a message from another node to local clients
+func (m *Manager) handleBrokerMessage(msg *BrokerMessage) {
+	if msg.NodeID == m.nodeID || m.seenBrokerMessage(msg.ID) {
+		return
+	}
+
+	switch msg.Kind {
+	case BrokerTopic:
+		if msg.Message != nil {
+			message := *msg.Message
+			m.deliverTopic(&message, nil)
+		}
+	case BrokerBroadcast:
+		m.broadcastLocal(msg.Data, nil)
+	case BrokerUser:
+		m.sendToUserLocal(msg.UserID, msg.Data)
+	case BrokerClose:
+		m.closeUserLocal(msg.UserID)
+	}
+}
+
+// seenBrokerMessage records a message ID and reports whether it was already delivered,
+// brokers deliver a message once per matching filter
+func (m *Manager) seenBrokerMessage(id string) bool {
+	if id == "" {
+		return false
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.seen[id] {
+		return true
+	}
+	m.seen[id] = true
+	m.seenIDs = append(m.seenIDs, id)
+	if len(m.seenIDs) > brokerSeenSize {
+		delete(m.seen, m.seenIDs[0])
+		m.seenIDs = m.seenIDs[1:]
+	}
+	return false
+}
+
+// addInterest counts a local subscriber of a filter, the caller must hold the mutex.
+// The broker subscription is applied by the cluster queue.
+func (m *Manager) addInterest(filter string) {
+	m.interest[filter]++
+	if m.interest[filter] == 1 && m.broker != nil {
+		broker := m.broker
+		m.queueCluster(func() {
+			if err := broker.Subscribe(filter); err != nil {
+				m.log().Error("Broker subscribe failed", "topic", filter, "error", err)
+			}
+		})
+	}
+}
+
+// removeInterest releases a local subscriber of a filter, the caller must hold the mutex.
+// The broker unsubscription is applied by the cluster queue.
+func (m *Manager) removeInterest(filter string) {
+	if m.interest[filter] == 0 {
+		return
+	}
+	m.interest[filter]--
+	if m.interest[filter] == 0 {
+		delete(m.interest, filter)
+		if m.broker != nil {
+			broker := m.broker
+			m.queueCluster(func() {
+				if err := broker.Unsubscribe(filter); err != nil {
+					m.log().Warn("Broker unsubscribe failed", "topic", filter, "error", err)
+				}
+			})
+		}
+	}
+}
+
+// queueCluster schedules a presence or broker update. Updates are recorded under the
+// mutex and applied in order by applyCluster, so a slow registry or broker round trip
+// never blocks fan-out.
+func (m *Manager) queueCluster(op func()) {
+	m.clusterMu.Lock()
+	defer m.clusterMu.Unlock()
+	m.clusterOps = append(m.clusterOps, op)
+	if !m.clusterBusy {
+		m.clusterBusy = true
+		go m.applyCluster()
+	}
+}
+
+// applyCluster runs the queued cluster updates one at a time until the queue is empty
+func (m *Manager) applyCluster() {
+	for {
+		m.clusterMu.Lock()
+		if len(m.clusterOps) == 0 {
+			m.clusterBusy = false
+			m.clusterMu.Unlock()
+			return
+		}
+		op := m.clusterOps[0]
+		m.clusterOps[0] = nil
+		m.clusterOps = m.clusterOps[1:]
+		m.clusterMu.Unlock()
+		op()
+	}
+}
+
+// syncCluster waits until the cluster updates queued so far have been applied,
+// the caller must not hold the mutex
+func (m *Manager) syncCluster() {
+	done := make(chan struct{})
+	m.queueCluster(func() { close(done) })
+	<-done
+}
@@ -0,0 +1,417 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Codec encodes and decodes the frames exchanged with a client
+type Codec interface {
+	// Name is the WebSocket subprotocol that selects this codec
+	Name() string
+	// Binary reports whether frames are sent as BinaryMessage
+	Binary() bool
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// ErrUnsupportedType is returned by codecs that cannot encode a value
+var ErrUnsupportedType = errors.New("codec: unsupported type")
+
+// JSONCodec encodes frames as JSON text, it is used when no subprotocol is negotiated
+type JSONCodec struct{}
+
+// Name returns the subprotocol name
+func (JSONCodec) Name() string { return "tkws.json" }
+
+// Binary returns false, JSON frames are sent as text
+func (JSONCodec) Binary() bool { return false }
+
+// Marshal encodes v as JSON
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+
+// Unmarshal decodes JSON data into v
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// MsgpackCodec encodes frames as MessagePack using the JSON field names
+type MsgpackCodec struct{}
+
+// Name returns the subprotocol name
+func (MsgpackCodec) Name() string { return "tkws.msgpack" }
+
+// Binary returns true
+func (MsgpackCodec) Binary() bool { return true }
+
+// Marshal encodes v as MessagePack
+func (MsgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal decodes MessagePack data into v
+func (MsgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
+
+// EncodeMsgpack encodes the JSON data as the equivalent MessagePack value
+func (d RawData) EncodeMsgpack(enc *msgpack.Encoder) error {
+	if len(d) == 0 {
+		return enc.EncodeNil()
+	}
+	dec := json.NewDecoder(bytes.NewReader(d))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return err
+	}
+	return enc.Encode(msgpackValue(v))
+}
+
+// DecodeMsgpack decodes a MessagePack value and stores it as JSON
+func (d *RawData) DecodeMsgpack(dec *msgpack.Decoder) error {
+	v, err := dec.DecodeInterface()
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		*d = nil
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("msgpack: data is not representable as JSON: %w", err)
+	}
+	*d = data
+	return nil
+}
+
+// msgpackValue converts the JSON numbers in a decoded value into integers where possible,
+// so they are not encoded as strings or floats
+func msgpackValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for key, value := range v {
+			v[key] = msgpackValue(value)
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = msgpackValue(value)
+		}
+	}
+	return v
+}
+
+// ProtobufCodec encodes frames with the schema in tkws.proto.
+// Every frame is a Frame message wrapping either an Envelope or a TopicResponse.
+type ProtobufCodec struct{}
+
+// Name returns the subprotocol name
+func (ProtobufCodec) Name() string { return "tkws.protobuf" }
+
+// Binary returns true
+func (ProtobufCodec) Binary() bool { return true }
+
+// Marshal encodes *Envelope and *TopicResponse values
+func (ProtobufCodec) Marshal(v interface{}) ([]byte, error) {
+	var (
+		field protowire.Number
+		body  []byte
+	)
+	switch msg := v.(type) {
+	case *Envelope:
+		field, body = 1, marshalEnvelopeProto(msg)
+	case *TopicResponse:
+		field, body = 2, marshalTopicResponseProto(msg)
+	default:
+		return nil, fmt.Errorf("%w %T", ErrUnsupportedType, v)
+	}
+	frame := protowire.AppendTag(nil, field, protowire.BytesType)
+	return protowire.AppendBytes(frame, body), nil
+}
+
+// Unmarshal decodes a Frame into *Envelope or *TopicResponse
+func (ProtobufCodec) Unmarshal(data []byte, v interface{}) error {
+	var body []byte
+	err := walkProto(data, func(num protowire.Number, typ protowire.Type, raw []byte, _ uint64) {
+		if typ == protowire.BytesType {
+			body = raw
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	switch msg := v.(type) {
+	case *Envelope:
+		return unmarshalEnvelopeProto(body, msg)
+	case *TopicResponse:
+		return unmarshalTopicResponseProto(body, msg)
+	default:
+		return fmt.Errorf("%w %T", ErrUnsupportedType, v)
+	}
+}
+
+func marshalEnvelopeProto(env *Envelope) []byte {
+	var b []byte
+	b = appendProtoVarint(b, 1, uint64(env.V))
+	b = appendProtoString(b, 2, env.Op)
+	b = appendProtoString(b, 3, env.ID)
+	b = appendProtoString(b, 4, env.Topic)
+	b = appendProtoBytes(b, 5, env.Data)
+	b = appendProtoString(b, 6, env.UserID)
+	b = appendProtoVarint(b, 7, uint64(env.Code))
+	b = appendProtoString(b, 8, env.Error)
+	if env.SinceSeq != nil {
+		b = protowire.AppendTag(b, 9, protowire.VarintType)
+		b = protowire.AppendVarint(b, *env.SinceSeq)
+	}
+	if env.SinceTime != nil {
+		b = protowire.AppendTag(b, 10, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(*env.SinceTime))
+	}
+	b = appendProtoString(b, 11, env.Session)
+	b = appendProtoBool(b, 12, env.Resumed)
+	b = appendProtoVarint(b, 13, uint64(env.QoS))
+	b = appendProtoString(b, 14, env.Token)
+	b = appendProtoBool(b, 15, env.ExcludeSelf)
+	b = appendProtoString(b, 16, env.Type)
+	b = appendProtoMap(b, 17, env.Trace)
+	return b
+}
+
+func unmarshalEnvelopeProto(data []byte, env *Envelope) error {
+	return walkProto(data, func(num protowire.Number, typ protowire.Type, raw []byte, n uint64) {
+		switch num {
+		case 1:
+			env.V = int(n)
+		case 2:
+			env.Op = string(raw)
+		case 3:
+			env.ID = string(raw)
+		case 4:
+			env.Topic = string(raw)
+		case 5:
+			env.Data = append(RawData(nil), raw...)
+		case 6:
+			env.UserID = string(raw)
+		case 7:
+			env.Code = int(n)
+		case 8:
+			env.Error = string(raw)
+		case 9:
+			seq := n
+			env.SinceSeq = &seq
+		case 10:
+			since := int64(n)
+			env.SinceTime = &since
+		case 11:
+			env.Session = string(raw)
+		case 12:
+			env.Resumed = n != 0
+		case 13:
+			env.QoS = int(n)
+		case 14:
+			env.Token = string(raw)
+		case 15:
+			env.ExcludeSelf = n != 0
+		case 16:
+			env.Type = string(raw)
+		case 17:
+			env.Trace = consumeProtoMapEntry(env.Trace, raw)
+		}
+	})
+}
+
+func marshalTopicResponseProto(msg *TopicResponse) []byte {
+	var b []byte
+	b = appendProtoString(b, 1, msg.Topic)
+	b = appendProtoString(b, 2, msg.Data)
+	b = appendProtoBool(b, 3, msg.Retained)
+	b = appendProtoVarint(b, 4, msg.Seq)
+	b = appendProtoString(b, 5, msg.ID)
+	b = appendProtoString(b, 6, msg.From)
+	b = appendProtoMap(b, 7, msg.Trace)
+	return b
+}
+
+func unmarshalTopicResponseProto(data []byte, msg *TopicResponse) error {
+	return walkProto(data, func(num protowire.Number, typ protowire.Type, raw []byte, n uint64) {
+		switch num {
+		case 1:
+			msg.Topic = string(raw)
+		case 2:
+			msg.Data = string(raw)
+		case 3:
+			msg.Retained = n != 0
+		case 4:
+			msg.Seq = n
+		case 5:
+			msg.ID = string(raw)
+		case 6:
+			msg.From = string(raw)
+		case 7:
+			msg.Trace = consumeProtoMapEntry(msg.Trace, raw)
+		}
+	})
+}
+
+func appendProtoVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendProtoBool(b []byte, num protowire.Number, v bool) []byte {
+	if !v {
+		return b
+	}
+	return appendProtoVarint(b, num, 1)
+}
+
+func appendProtoString(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+func appendProtoBytes(b []byte, num protowire.Number, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+// appendProtoMap encodes a map<string, string> field as one entry message per key
+func appendProtoMap(b []byte, num protowire.Number, m map[string]string) []byte {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		var entry []byte
+		entry = appendProtoString(entry, 1, key)
+		entry = appendProtoString(entry, 2, m[key])
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	return b
+}
+
+// consumeProtoMapEntry decodes one map<string, string> entry into m, allocating it if needed
+func consumeProtoMapEntry(m map[string]string, entry []byte) map[string]string {
+	var key, value string
+	walkProto(entry, func(num protowire.Number, typ protowire.Type, raw []byte, n uint64) {
+		switch num {
+		case 1:
+			key = string(raw)
+		case 2:
+			value = string(raw)
+		}
+	})
+	if m == nil {
+		m = make(map[string]string)
+	}
+	m[key] = value
+	return m
+}
+
+// walkProto calls fn for every varint and length-delimited field, other wire types are skipped
+func walkProto(data []byte, fn func(num protowire.Number, typ protowire.Type, raw []byte, n uint64)) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		switch typ {
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			fn(num, typ, nil, v)
+			data = data[n:]
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			fn(num, typ, v, 0)
+			data = data[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			data = data[n:]
+		}
+	}
+	return nil
+}
+
+// RegisterCodec registers a codec that clients can select via Sec-WebSocket-Protocol
+func (m *Manager) RegisterCodec(codec Codec) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.codecs[codec.Name()]; !ok {
+		m.codecNames = append(m.codecNames, codec.Name())
+	}
+	m.codecs[codec.Name()] = codec
+}
+
+// codecFor returns the codec for a negotiated subprotocol, falling back to JSON
+func (m *Manager) codecFor(subprotocol string) Codec {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if codec, ok := m.codecs[subprotocol]; ok {
+		return codec
+	}
+	return JSONCodec{}
+}
+
+// subprotocols returns the registered codec names in registration order
+func (m *Manager) subprotocols() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]string(nil), m.codecNames...)
+}
+
+// encodeFrame encodes v with the client's codec, caching the result per codec
+func encodeFrame(cache map[string][]byte, codec Codec, v interface{}) ([]byte, error) {
+	if frame, ok := cache[codec.Name()]; ok {
+		return frame, nil
+	}
+	frame, err := codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	cache[codec.Name()] = frame
+	return frame, nil
+}
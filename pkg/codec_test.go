@@ -0,0 +1,120 @@
+package pkg
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// dialMsgpack connects a client that negotiates the MessagePack codec
+func dialMsgpack(t *testing.T, url string) *websocket.Conn {
+	t.Helper()
+	dialer := websocket.Dialer{Subprotocols: []string{MsgpackCodec{}.Name()}}
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+// readMsgpack reads MessagePack frames into generic maps until one satisfies match
+func readMsgpack(t *testing.T, conn *websocket.Conn, match func(frame map[string]interface{}) bool) map[string]interface{} {
+	t.Helper()
+	for {
+		messageType, message, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		var frame map[string]interface{}
+		if messageType == websocket.BinaryMessage && msgpack.Unmarshal(message, &frame) == nil && match(frame) {
+			return frame
+		}
+	}
+}
+
+func TestRawPayloadsAreTextFramesForBinaryCodecs(t *testing.T) {
+	m, _, url := startTestManager(t)
+	conn := dialMsgpack(t, url+"?user_id=u1")
+
+	// The welcome envelope is encoded by the codec
+	messageType, frame, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("read welcome: %v", err)
+	}
+	var welcome Envelope
+	if messageType != websocket.BinaryMessage || (MsgpackCodec{}).Unmarshal(frame, &welcome) != nil || welcome.Op != OpWelcome {
+		t.Fatalf("got welcome frame type %d, want a binary msgpack envelope", messageType)
+	}
+
+	for m.GetUserConnectionCount("u1") == 0 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	m.BroadcastMessage([]byte("hello"), nil)
+	m.SendToUser("u1", []byte("direct"))
+	for _, want := range []string{"hello", "direct"} {
+		messageType, frame, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if messageType != websocket.TextMessage || string(frame) != want {
+			t.Fatalf("got frame type %d with %q, want a text frame with %q", messageType, frame, want)
+		}
+	}
+}
+
+func TestMsgpackDataIsNative(t *testing.T) {
+	m, _, url := startTestManager(t)
+	m.Handle("chat", func(ctx *HandlerContext) error {
+		var in struct{ X int }
+		if err := ctx.Bind(&in); err != nil {
+			return err
+		}
+		return ctx.Reply(map[string]interface{}{"y": []int{in.X, in.X + 1}})
+	})
+	conn := dialMsgpack(t, url)
+
+	frame, err := msgpack.Marshal(map[string]interface{}{"type": "chat", "id": "1", "data": map[string]interface{}{"x": 1}})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	conn.WriteMessage(websocket.BinaryMessage, frame)
+	reply := readMsgpack(t, conn, func(frame map[string]interface{}) bool { return frame["id"] == "1" })
+	if reply["op"] != OpReply {
+		t.Fatalf("got %v, want a reply", reply)
+	}
+	data, _ := reply["data"].(map[string]interface{})
+	y, _ := data["y"].([]interface{})
+	if len(y) != 2 || y[0] != int8(1) || y[1] != int8(2) {
+		t.Fatalf("reply data %#v, want a map with y [1 2]", reply["data"])
+	}
+}
+
+func TestInvalidBinaryFrameIsNotBroadcast(t *testing.T) {
+	_, _, url := startTestManager(t)
+	conn := dialMsgpack(t, url)
+	other := dialTest(t, url)
+	other.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := other.ReadMessage(); err != nil {
+		t.Fatalf("read welcome: %v", err)
+	}
+
+	// A map with a non-string key has no JSON equivalent
+	frame, _ := msgpack.Marshal(map[string]interface{}{"type": "chat", "data": map[int]int{1: 2}})
+	conn.WriteMessage(websocket.BinaryMessage, frame)
+	conn.WriteMessage(websocket.BinaryMessage, []byte{0xc1})
+	for i := 0; i < 2; i++ {
+		reply := readMsgpack(t, conn, func(frame map[string]interface{}) bool { return frame["op"] == OpError })
+		if reply["code"] != int16(1008) && reply["code"] != uint16(1008) {
+			t.Fatalf("got %v, want error 1008", reply)
+		}
+	}
+
+	other.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, message, err := other.ReadMessage(); err == nil {
+		t.Fatalf("invalid frame was broadcast as %q", message)
+	}
+}
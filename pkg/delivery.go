@@ -0,0 +1,139 @@
+package pkg
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// pendingMessage is a QoS 1 topic message awaiting the client's acknowledgement
+type pendingMessage struct {
+	message  *TopicResponse
+	attempts int
+	sentAt   time.Time
+	timer    *time.Timer
+}
+
+// EnableAckDelivery enables at-least-once delivery for subscriptions made with qos 1.
+// Unacknowledged messages are redelivered after timeout, at most maxRetries times.
+func (m *Manager) EnableAckDelivery(timeout time.Duration, maxRetries int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.ackDelivery = true
+	m.ackTimeout = timeout
+	m.ackMaxRetries = maxRetries
+}
+
+// DisableAckDelivery reverts to fire-and-forget delivery, pending messages are discarded
+func (m *Manager) DisableAckDelivery() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.ackDelivery = false
+	for client := range m.Clients {
+		client.clearPending()
+	}
+}
+
+// wantsAck reports whether a client subscribed to the topic with qos 1
+func (c *Client) wantsAck(topic string) bool {
+	for filter, qos := range c.qos {
+		if qos > 0 && TopicMatches(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// trackDelivery starts the redelivery timer for a QoS 1 message, the caller must hold the mutex
+func (m *Manager) trackDelivery(client *Client, message *TopicResponse) {
+	if !m.ackDelivery || message.ID == "" || !client.wantsAck(message.Topic) {
+		return
+	}
+	if _, ok := client.pending[message.ID]; ok {
+		return
+	}
+
+	pending := &pendingMessage{message: message, attempts: 1, sentAt: time.Now()}
+	pending.timer = time.AfterFunc(m.ackTimeout, func() {
+		m.redeliver(client, message.ID)
+	})
+	client.pending[message.ID] = pending
+}
+
+// redeliver resends an unacknowledged message or gives up after the retry limit
+func (m *Manager) redeliver(client *Client, id string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	pending, ok := client.pending[id]
+	if !ok {
+		return
+	}
+	if _, ok := m.Clients[client]; !ok {
+		delete(client.pending, id)
+		return
+	}
+
+	if pending.attempts > m.ackMaxRetries {
+		delete(client.pending, id)
+		m.reportError(&ErrorEvent{
+			Client: client,
+			Message: fmt.Sprintf("Message %s on topic %s not acknowledged after %d attempts",
+				id, pending.message.Topic, pending.attempts),
+			Code: 1012,
+			Time: time.Now(),
+		})
+		return
+	}
+
+	frame, err := client.codec.Marshal(pending.message)
+	if err != nil {
+		delete(client.pending, id)
+		return
+	}
+	if client.enqueue(frame) {
+		m.debugLog("Redelivered message", client.logArgs("message_id", id, "topic", pending.message.Topic, "attempt", pending.attempts+1)...)
+	}
+	pending.attempts++
+	pending.timer.Reset(m.ackTimeout)
+}
+
+// acknowledge removes a message from the client's pending set
+func (m *Manager) acknowledge(client *Client, id string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	pending, ok := client.pending[id]
+	if !ok {
+		return false
+	}
+	pending.timer.Stop()
+	delete(client.pending, id)
+	return true
+}
+
+// clearPending stops all redelivery timers, the caller must hold the mutex
+func (c *Client) clearPending() {
+	for id, pending := range c.pending {
+		pending.timer.Stop()
+		delete(c.pending, id)
+	}
+}
+
+// pendingMessages returns the unacknowledged messages in the order they were sent,
+// the caller must hold the mutex
+func (c *Client) pendingMessages() []*TopicResponse {
+	pending := make([]*pendingMessage, 0, len(c.pending))
+	for _, p := range c.pending {
+		pending = append(pending, p)
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].sentAt.Before(pending[j].sentAt)
+	})
+
+	messages := make([]*TopicResponse, len(pending))
+	for i, p := range pending {
+		messages[i] = p.message
+	}
+	return messages
+}
@@ -0,0 +1,106 @@
+package pkg
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// subscribeQoS subscribes a connection to a topic with at-least-once delivery
+func subscribeQoS(t *testing.T, conn *websocket.Conn, topic string) {
+	t.Helper()
+	conn.WriteJSON(map[string]interface{}{"op": OpSubscribe, "id": "sub", "topic": topic, "qos": 1})
+	readFrame(t, conn, func(frame map[string]interface{}) bool { return frame["op"] == OpSubscribed })
+}
+
+// readTopic reads the next topic message
+func readTopic(t *testing.T, conn *websocket.Conn) map[string]interface{} {
+	t.Helper()
+	return readFrame(t, conn, func(frame map[string]interface{}) bool { return frame["topic"] != nil })
+}
+
+func TestAckDeliveryRedelivers(t *testing.T) {
+	m, _, url := startTestManager(t)
+	m.EnableAckDelivery(100*time.Millisecond, 5)
+	conn := dialTest(t, url)
+	subscribeQoS(t, conn, "news")
+
+	m.PublishTopicMessage(context.Background(), "news", "hello")
+	first := readTopic(t, conn)
+	id, _ := first["id"].(string)
+	if first["data"] != "hello" || id == "" {
+		t.Fatalf("first delivery %v, want hello with a message ID", first)
+	}
+	if again := readTopic(t, conn); again["id"] != id || again["data"] != "hello" {
+		t.Fatalf("redelivery %v, want message %s again", again, id)
+	}
+
+	conn.WriteJSON(map[string]interface{}{"op": OpAck, "id": id})
+	readFrame(t, conn, func(frame map[string]interface{}) bool { return frame["op"] == OpAcked })
+	pending := 0
+	m.mutex.Lock()
+	for client := range m.Clients {
+		pending += len(client.pending)
+	}
+	m.mutex.Unlock()
+	if pending != 0 {
+		t.Fatalf("%d messages pending after the ack", pending)
+	}
+
+	// Nothing is redelivered after the ack, the next message is the marker
+	time.Sleep(250 * time.Millisecond)
+	m.PublishTopicMessage(context.Background(), "news", "marker")
+	if frame := readTopic(t, conn); frame["data"] != "marker" {
+		t.Fatalf("received %v after the ack, want the marker", frame)
+	}
+}
+
+func TestAckDeliveryGivesUp(t *testing.T) {
+	m, _, url := startTestManager(t)
+	m.EnableAckDelivery(20*time.Millisecond, 2)
+	conn := dialTest(t, url)
+	subscribeQoS(t, conn, "news")
+
+	m.PublishTopicMessage(context.Background(), "news", "hello")
+	event := waitError(t, m, 1012)
+	if event.Message == "" || event.Client == nil {
+		t.Fatalf("retry exhaustion reported as %+v", event)
+	}
+
+	// The first delivery and two redeliveries, then the marker
+	m.PublishTopicMessage(context.Background(), "news", "marker")
+	deliveries := 0
+	for {
+		frame := readTopic(t, conn)
+		if frame["data"] == "marker" {
+			break
+		}
+		deliveries++
+	}
+	if deliveries != 3 {
+		t.Fatalf("delivered %d times, want 3", deliveries)
+	}
+}
+
+func TestAckDeliveryOnlyForQoS(t *testing.T) {
+	m, _, url := startTestManager(t)
+	m.EnableAckDelivery(20*time.Millisecond, 5)
+	conn := dialTest(t, url)
+	subscribeTest(t, conn, "news")
+
+	m.PublishTopicMessage(context.Background(), "news", "hello")
+	readTopic(t, conn)
+	time.Sleep(100 * time.Millisecond)
+	m.PublishTopicMessage(context.Background(), "news", "marker")
+	if frame := readTopic(t, conn); frame["data"] != "marker" {
+		t.Fatalf("qos 0 message redelivered: %v", frame)
+	}
+
+	// Acks need an ID
+	conn.WriteJSON(map[string]interface{}{"op": OpAck})
+	if frame := readFrame(t, conn, func(frame map[string]interface{}) bool { return frame["op"] == OpError }); frame["code"] != float64(1008) {
+		t.Fatalf("ack without an ID answered %v, want code 1008", frame)
+	}
+}
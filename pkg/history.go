@@ -0,0 +1,190 @@
+package pkg
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// historyEntry is a published topic message with its publish time
+type historyEntry struct {
+	message TopicResponse
+	time    time.Time
+}
+
+// topicHistory is a bounded ring buffer of the most recent messages of a topic
+type topicHistory struct {
+	entries []historyEntry
+	next    int
+	full    bool
+}
+
+func newTopicHistory(size int) *topicHistory {
+	return &topicHistory{entries: make([]historyEntry, size)}
+}
+
+// add appends a message, overwriting the oldest one when the buffer is full
+func (h *topicHistory) add(message TopicResponse, at time.Time) {
+	h.entries[h.next] = historyEntry{message: message, time: at}
+	h.next = (h.next + 1) % len(h.entries)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// all returns the buffered entries from oldest to newest
+func (h *topicHistory) all() []historyEntry {
+	if !h.full {
+		return append([]historyEntry(nil), h.entries[:h.next]...)
+	}
+	return append(append([]historyEntry(nil), h.entries[h.next:]...), h.entries[:h.next]...)
+}
+
+// EnableHistory keeps the last size messages of every topic for replay
+func (m *Manager) EnableHistory(size int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if size != m.historySize {
+		m.history = make(map[string]*topicHistory)
+	}
+	m.historySize = size
+}
+
+// DisableHistory stops recording topic history and drops buffered messages
+func (m *Manager) DisableHistory() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.historySize = 0
+	m.history = make(map[string]*topicHistory)
+}
+
+// GetTopicHistory gets the buffered messages of a topic from oldest to newest
+func (m *Manager) GetTopicHistory(topic string) []TopicResponse {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	history, ok := m.history[topic]
+	if !ok {
+		return nil
+	}
+	entries := history.all()
+	messages := make([]TopicResponse, len(entries))
+	for i, entry := range entries {
+		messages[i] = entry.message
+	}
+	return messages
+}
+
+// assignSeq numbers a message with the next sequence number of its topic. A message
+// numbered by another node or a HistoryBroker keeps its seq and advances the counter.
+// The caller must hold the mutex.
+func (m *Manager) assignSeq(message *TopicResponse) {
+	if message.Seq == 0 {
+		m.topicSeq[message.Topic]++
+		message.Seq = m.topicSeq[message.Topic]
+	} else if message.Seq > m.topicSeq[message.Topic] {
+		m.topicSeq[message.Topic] = message.Seq
+	}
+}
+
+// recordMessage numbers the message if needed and buffers it, the caller must hold the mutex
+func (m *Manager) recordMessage(message *TopicResponse) {
+	m.assignSeq(message)
+
+	if m.historySize <= 0 {
+		return
+	}
+	history, ok := m.history[message.Topic]
+	if !ok {
+		history = newTopicHistory(m.historySize)
+		m.history[message.Topic] = history
+	}
+	history.add(*message, time.Now())
+}
+
+// replayBrokerHistory fetches the stored messages matching a new subscription from a
+// HistoryBroker without holding the mutex, which a slow store would block, and sends
+// them unless the client unsubscribed in the meantime. Live messages for the client
+// are held back until then and sent after the replay, skipping those it contained.
+func (m *Manager) replayBrokerHistory(store HistoryBroker, client *Client, filter string, sinceSeq *uint64, sinceTime *int64) {
+	messages, err := store.History(filter, derefSeq(sinceSeq), derefTime(sinceTime))
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	defer m.releaseHeld(client, messages)
+	if !client.topics[filter] {
+		return
+	}
+	if err != nil {
+		m.log().Warn("Broker history failed, replaying local history", client.logArgs("topic", filter, "error", err)...)
+		m.replayHistory(client, filter, sinceSeq, sinceTime)
+		return
+	}
+	for _, message := range messages {
+		m.sendTopicFrame(context.Background(), client, make(map[string][]byte), message)
+	}
+}
+
+// releaseHeld ends a broker history replay and, once the client has none left, sends the
+// live messages held back meanwhile except those replayed. The caller must hold the mutex.
+func (m *Manager) releaseHeld(client *Client, replayed []*TopicResponse) {
+	client.replaying--
+	if client.replaying > 0 {
+		return
+	}
+	type seqKey struct {
+		topic string
+		seq   uint64
+	}
+	sent := make(map[seqKey]bool, len(replayed))
+	for _, message := range replayed {
+		sent[seqKey{message.Topic, message.Seq}] = true
+	}
+	held := client.held
+	client.held = nil
+	for _, message := range held {
+		if message.Seq == 0 || !sent[seqKey{message.Topic, message.Seq}] {
+			m.sendTopicFrame(context.Background(), client, make(map[string][]byte), message)
+		}
+	}
+}
+
+// replayHistory sends buffered messages matching a filter that were published after
+// sinceSeq or at/after sinceTime, oldest first. The caller must hold the mutex.
+func (m *Manager) replayHistory(client *Client, filter string, sinceSeq *uint64, sinceTime *int64) {
+	var replay []historyEntry
+	for topic, history := range m.history {
+		if !TopicMatches(filter, topic) {
+			continue
+		}
+		for _, entry := range history.all() {
+			if sinceSeq != nil && entry.message.Seq <= *sinceSeq {
+				continue
+			}
+			if sinceTime != nil && entry.time.Before(time.UnixMilli(*sinceTime)) {
+				continue
+			}
+			replay = append(replay, entry)
+		}
+	}
+	sort.SliceStable(replay, func(i, j int) bool {
+		return replay[i].time.Before(replay[j].time)
+	})
+
+	for i := range replay {
+		m.sendTopicFrame(context.Background(), client, make(map[string][]byte), &replay[i].message)
+	}
+}
+
+func derefSeq(seq *uint64) uint64 {
+	if seq == nil {
+		return 0
+	}
+	return *seq
+}
+
+func derefTime(ms *int64) time.Time {
+	if ms == nil {
+		return time.Time{}
+	}
+	return time.UnixMilli(*ms)
+}
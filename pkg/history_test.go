@@ -0,0 +1,122 @@
+package pkg
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowHistoryBroker stores topic messages like a HistoryBroker whose History waits
+// until release is closed
+type slowHistoryBroker struct {
+	Broker
+	fetching chan struct{}
+	release  chan struct{}
+
+	mutex  sync.Mutex
+	stored []*TopicResponse
+}
+
+func (b *slowHistoryBroker) Publish(msg *BrokerMessage) error {
+	if msg.Kind == BrokerTopic {
+		b.mutex.Lock()
+		msg.Message.Seq = uint64(len(b.stored) + 1)
+		stored := *msg.Message
+		b.stored = append(b.stored, &stored)
+		b.mutex.Unlock()
+	}
+	return b.Broker.Publish(msg)
+}
+
+func (b *slowHistoryBroker) History(filter string, sinceSeq uint64, since time.Time) ([]*TopicResponse, error) {
+	b.fetching <- struct{}{}
+	<-b.release
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	var messages []*TopicResponse
+	for _, message := range b.stored {
+		if message.Seq > sinceSeq && TopicMatches(filter, message.Topic) {
+			messages = append(messages, message)
+		}
+	}
+	return messages, nil
+}
+
+func TestSeqIsRelayedToOtherNodes(t *testing.T) {
+	bus := NewMemoryBus()
+	node1 := NewManager()
+	go node1.Start()
+	if err := node1.SetBroker(bus.NewBroker()); err != nil {
+		t.Fatalf("set broker: %v", err)
+	}
+	node2, _, url := startTestManager(t)
+	if err := node2.SetBroker(bus.NewBroker()); err != nil {
+		t.Fatalf("set broker: %v", err)
+	}
+
+	// Published while node2 has no subscribers, so only node1 counts them
+	node1.PublishTopicMessage(context.Background(), "news", "1")
+	node1.PublishTopicMessage(context.Background(), "news", "2")
+
+	conn := dialTest(t, url)
+	subscribeTest(t, conn, "news")
+	// The broker subscription is applied after the subscription is acknowledged
+	node2.syncCluster()
+	node1.PublishTopicMessage(context.Background(), "news", "3")
+	frame := readFrame(t, conn, func(frame map[string]interface{}) bool { return frame["data"] == "3" })
+	if frame["seq"] != float64(3) {
+		t.Fatalf("node2 delivered seq %v, want the publisher's 3", frame["seq"])
+	}
+}
+
+func TestBrokerReplayPrecedesLiveMessages(t *testing.T) {
+	m, _, url := startTestManager(t)
+	broker := &slowHistoryBroker{Broker: NewMemoryBus().NewBroker(), fetching: make(chan struct{}), release: make(chan struct{})}
+	if err := m.SetBroker(broker); err != nil {
+		t.Fatalf("set broker: %v", err)
+	}
+	m.PublishTopicMessage(context.Background(), "news", "old")
+
+	conn := dialTest(t, url)
+	conn.WriteJSON(map[string]interface{}{"op": OpSubscribe, "topic": "news", "since_seq": 0})
+	readFrame(t, conn, func(frame map[string]interface{}) bool { return frame["op"] == OpSubscribed })
+	<-broker.fetching
+
+	// Published while the history is fetched, so it is also part of the replay
+	m.PublishTopicMessage(context.Background(), "news", "live")
+	close(broker.release)
+	m.PublishTopicMessage(context.Background(), "news", "after")
+
+	var got []interface{}
+	for len(got) == 0 || got[len(got)-1] != "after" {
+		frame := readFrame(t, conn, func(frame map[string]interface{}) bool { return frame["topic"] == "news" })
+		got = append(got, frame["data"])
+	}
+	if len(got) != 3 || got[0] != "old" || got[1] != "live" {
+		t.Fatalf("received %v, want [old live after]", got)
+	}
+}
+
+func TestSinceSeqRequiresTopicWithoutWildcards(t *testing.T) {
+	m, _, url := startTestManager(t)
+	m.EnableHistory(10)
+	m.PublishTopicMessage(context.Background(), "game/a", "a1")
+	m.PublishTopicMessage(context.Background(), "game/b", "b1")
+	conn := dialTest(t, url)
+
+	conn.WriteJSON(map[string]interface{}{"op": OpSubscribe, "id": "seq", "topic": "game/#", "since_seq": 0})
+	frame := readFrame(t, conn, func(frame map[string]interface{}) bool { return frame["id"] == "seq" })
+	if frame["op"] != OpError || frame["code"] != float64(1008) {
+		t.Fatalf("got %v, want error 1008", frame)
+	}
+
+	conn.WriteJSON(map[string]interface{}{"op": OpSubscribe, "id": "time", "topic": "game/#", "since_time": 0})
+	readFrame(t, conn, func(frame map[string]interface{}) bool { return frame["op"] == OpSubscribed })
+	for _, want := range []string{"a1", "b1"} {
+		frame := readFrame(t, conn, func(frame map[string]interface{}) bool { return frame["topic"] != nil })
+		if frame["data"] != want {
+			t.Fatalf("replayed %v, want %s", frame["data"], want)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package pkg
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers of HMAC-signed publish requests
+const (
+	PublishSignatureHeader = "X-Tkws-Signature" // "sha256=" + hex HMAC of timestamp + "." + body
+	PublishTimestampHeader = "X-Tkws-Timestamp" // Unix time in seconds
+)
+
+// publishBodyLimit caps the size of publish request bodies
+const publishBodyLimit = 1 << 20
+
+// PublishOptions configures the authentication of the HTTP publish API. A request is
+// accepted if it carries one of the API keys or a valid HMAC signature.
+type PublishOptions struct {
+	APIKeys    []string      // Keys accepted in "Authorization: Bearer <key>" or "X-API-Key"
+	HMACSecret []byte        // Secret of the X-Tkws-Signature header
+	MaxSkew    time.Duration // Accepted age of signed requests, 5 minutes by default
+}
+
+// PublishResult reports how many local subscribers received a published message
+type PublishResult struct {
+	Topic     string `json:"topic"`
+	Delivered int    `json:"delivered"`
+	Error     string `json:"error,omitempty"` // Set for the messages of a batch that stopped early
+}
+
+// publishRequest is one message of a publish request, Topic is taken from the
+// path for single publishes
+type publishRequest struct {
+	Topic string          `json:"topic"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// PublishHandler returns an http.Handler that lets backends publish without a socket.
+// Mount it with http.StripPrefix, e.g. under "/publish" at both "/publish" and "/publish/":
+//
+//	POST /{topic}  publishes {"data": ...} to the topic
+//	POST /         publishes {"messages": [{"topic": ..., "data": ...}]}
+//
+// Responses report how many local subscribers received each message. A request whose
+// context ends before its messages are delivered is answered with 504 on timeout and
+// 503 otherwise. Batches are not atomic: a batch that stops early still lists every
+// message, the one in flight carries the context error and may have been delivered,
+// and the rest are marked "not published".
+func (m *Manager) PublishHandler(opts PublishOptions) http.Handler {
+	if opts.MaxSkew <= 0 {
+		opts.MaxSkew = 5 * time.Minute
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, publishBodyLimit+1))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "failed to read body")
+			return
+		}
+		if len(body) > publishBodyLimit {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, "body too large")
+			return
+		}
+		if !opts.authenticate(r, body) {
+			writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+
+		if topic := strings.TrimPrefix(r.URL.Path, "/"); topic != "" {
+			m.publishOne(w, r, topic, body)
+		} else {
+			m.publishBatch(w, r, body)
+		}
+	})
+}
+
+func (m *Manager) publishOne(w http.ResponseWriter, r *http.Request, topic string, body []byte) {
+	if !validTopicName(topic) {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid topic %q", topic))
+		return
+	}
+	var msg publishRequest
+	if err := json.Unmarshal(body, &msg); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid JSON body: %v", err))
+		return
+	}
+
+	delivered, err := m.PublishTopicMessage(r.Context(), topic, envelopeData(msg.Data))
+	if err != nil {
+		writePublishError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, PublishResult{Topic: topic, Delivered: delivered})
+}
+
+func (m *Manager) publishBatch(w http.ResponseWriter, r *http.Request, body []byte) {
+	var batch struct {
+		Messages []publishRequest `json:"messages"`
+	}
+	if err := json.Unmarshal(body, &batch); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid JSON body: %v", err))
+		return
+	}
+	if len(batch.Messages) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "messages are required")
+		return
+	}
+	// Reject the whole batch before publishing anything
+	for i, msg := range batch.Messages {
+		if !validTopicName(msg.Topic) {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid topic %q in message %d", msg.Topic, i))
+			return
+		}
+	}
+
+	results := make([]PublishResult, len(batch.Messages))
+	for i, msg := range batch.Messages {
+		results[i].Topic = msg.Topic
+	}
+	for i, msg := range batch.Messages {
+		delivered, err := m.PublishTopicMessage(r.Context(), msg.Topic, envelopeData(msg.Data))
+		if err != nil {
+			// The messages before i stay published
+			status, message := publishError(err)
+			results[i].Error = message
+			for j := i + 1; j < len(results); j++ {
+				results[j].Error = "not published"
+			}
+			writeJSON(w, status, map[string]interface{}{"error": message, "results": results})
+			return
+		}
+		results[i].Delivered = delivered
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"results": results})
+}
+
+// writePublishError answers a publish whose request context ended before delivery
+func writePublishError(w http.ResponseWriter, err error) {
+	status, message := publishError(err)
+	writeJSONError(w, status, message)
+}
+
+// publishError maps the context error of a publish to a status and message
+func publishError(err error) (int, string) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout, "publish timed out"
+	}
+	return http.StatusServiceUnavailable, "publish cancelled"
+}
+
+// authenticate checks the API key or the HMAC signature of a request
+func (opts PublishOptions) authenticate(r *http.Request, body []byte) bool {
+	if key := publishAPIKey(r); key != "" {
+		for _, candidate := range opts.APIKeys {
+			if subtle.ConstantTimeCompare([]byte(key), []byte(candidate)) == 1 {
+				return true
+			}
+		}
+		return false
+	}
+	if len(opts.HMACSecret) == 0 {
+		return false
+	}
+	return opts.verifySignature(r, body)
+}
+
+// verifySignature checks a request's HMAC signature and that its timestamp is recent
+func (opts PublishOptions) verifySignature(r *http.Request, body []byte) bool {
+	timestamp := r.Header.Get(PublishTimestampHeader)
+	signature, ok := strings.CutPrefix(r.Header.Get(PublishSignatureHeader), "sha256=")
+	if timestamp == "" || !ok {
+		return false
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := time.Since(time.Unix(unix, 0)); age > opts.MaxSkew || age < -opts.MaxSkew {
+		return false
+	}
+	got, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(got, SignPublishRequest(opts.HMACSecret, timestamp, body))
+}
+
+// SignPublishRequest computes the HMAC-SHA256 of a publish request, sent hex-encoded
+// as "sha256=<hex>" in the X-Tkws-Signature header along with the X-Tkws-Timestamp
+func SignPublishRequest(secret []byte, timestamp string, body []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// publishAPIKey gets the API key of a request from the bearer token or X-API-Key
+func publishAPIKey(r *http.Request) string {
+	if key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return key
+	}
+	return r.Header.Get("X-API-Key")
+}
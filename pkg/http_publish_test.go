@@ -0,0 +1,102 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func publishTest(t *testing.T, handler http.Handler, ctx context.Context, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)).WithContext(ctx)
+	r.Header.Set("X-API-Key", "key")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestPublishHandlerMountPoint(t *testing.T) {
+	m, _, url := startTestManager(t)
+	conn := dialTest(t, url)
+	subscribeTest(t, conn, "game/+")
+
+	mux := http.NewServeMux()
+	publish := http.StripPrefix("/api/publish", m.PublishHandler(PublishOptions{APIKeys: []string{"key"}}))
+	mux.Handle("/api/publish", publish)
+	mux.Handle("/api/publish/", publish)
+
+	w := publishTest(t, mux, context.Background(), "/api/publish/game/room1", `{"data":"single"}`)
+	var single PublishResult
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &single) != nil || single != (PublishResult{Topic: "game/room1", Delivered: 1}) {
+		t.Fatalf("single publish answered %d %s", w.Code, w.Body)
+	}
+	readFrame(t, conn, func(frame map[string]interface{}) bool { return frame["data"] == "single" })
+
+	for _, path := range []string{"/api/publish", "/api/publish/"} {
+		w = publishTest(t, mux, context.Background(), path, `{"messages":[{"topic":"game/room2","data":"batch"}]}`)
+		var batch struct{ Results []PublishResult }
+		if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &batch) != nil || len(batch.Results) != 1 || batch.Results[0].Delivered != 1 {
+			t.Fatalf("batch publish to %s answered %d %s", path, w.Code, w.Body)
+		}
+		readFrame(t, conn, func(frame map[string]interface{}) bool { return frame["data"] == "batch" })
+	}
+}
+
+func TestPublishHandlerContextDone(t *testing.T) {
+	// The manager is not started, so publishes are never picked up
+	m := NewManager()
+	handler := m.PublishHandler(PublishOptions{APIKeys: []string{"key"}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if w := publishTest(t, handler, ctx, "/game/room1", `{"data":"hello"}`); w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("timed out publish answered %d, want 504", w.Code)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if w := publishTest(t, handler, ctx, "/", `{"messages":[{"topic":"game/room1","data":"hello"}]}`); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("cancelled publish answered %d, want 503", w.Code)
+	}
+}
+
+func TestPublishBatchStoppedEarly(t *testing.T) {
+	// Stand in for the event loop: deliver the first message, then cancel the
+	// request while the second one is in flight
+	m := NewManager()
+	handler := m.PublishHandler(PublishOptions{APIKeys: []string{"key"}})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		pub := <-m.publishes
+		pub.result <- 1
+		<-m.publishes
+		cancel()
+	}()
+
+	w := publishTest(t, handler, ctx, "/", `{"messages":[{"topic":"a","data":1},{"topic":"b","data":2},{"topic":"c","data":3}]}`)
+	var batch struct {
+		Error   string
+		Results []PublishResult
+	}
+	if w.Code != http.StatusServiceUnavailable || json.Unmarshal(w.Body.Bytes(), &batch) != nil {
+		t.Fatalf("cancelled batch answered %d %s, want 503", w.Code, w.Body)
+	}
+	want := []PublishResult{
+		{Topic: "a", Delivered: 1},
+		{Topic: "b", Error: "publish cancelled"},
+		{Topic: "c", Error: "not published"},
+	}
+	if batch.Error != "publish cancelled" || len(batch.Results) != len(want) {
+		t.Fatalf("cancelled batch answered %s", w.Body)
+	}
+	for i := range want {
+		if batch.Results[i] != want[i] {
+			t.Errorf("result %d = %+v, want %+v", i, batch.Results[i], want[i])
+		}
+	}
+}
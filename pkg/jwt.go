@@ -0,0 +1,337 @@
+package pkg
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Supported JWT signing algorithms
+const (
+	JWTAlgHS256 = "HS256"
+	JWTAlgRS256 = "RS256"
+	JWTAlgES256 = "ES256"
+)
+
+// JWTKey is a verification key. Key is a []byte secret for HS256,
+// an *rsa.PublicKey for RS256 or an *ecdsa.PublicKey on P-256 for ES256.
+type JWTKey struct {
+	ID        string // Matched against the token's "kid" header, empty matches any token
+	Algorithm string
+	Key       interface{}
+}
+
+// JWTOptions configures where tokens are read from and how claims are validated
+type JWTOptions struct {
+	Header            string        // Header carrying "Bearer <token>", defaults to "Authorization"
+	QueryParam        string        // Query parameter carrying the token, defaults to "token"
+	SubprotocolPrefix string        // Sec-WebSocket-Protocol entry "<prefix><token>", defaults to "tkws.token."
+	Issuer            string        // Required "iss" if set
+	Audience          string        // Required "aud" entry if set
+	Leeway            time.Duration // Clock skew tolerated for "exp" and "nbf"
+	RolesClaim        string        // Claim holding the roles, defaults to "roles"
+}
+
+// JWTAuthenticator authenticates connections with JSON Web Tokens. The "sub" claim
+// becomes the user ID and "exp" plus the leeway the principal's expiry.
+type JWTAuthenticator struct {
+	opts JWTOptions
+
+	mutex    sync.RWMutex
+	keys     []JWTKey
+	jwksPath string
+}
+
+// NewJWTAuthenticator creates a JWT authenticator with a static key set
+func NewJWTAuthenticator(opts JWTOptions, keys ...JWTKey) *JWTAuthenticator {
+	if opts.Header == "" {
+		opts.Header = "Authorization"
+	}
+	if opts.QueryParam == "" {
+		opts.QueryParam = "token"
+	}
+	if opts.SubprotocolPrefix == "" {
+		opts.SubprotocolPrefix = "tkws.token."
+	}
+	if opts.RolesClaim == "" {
+		opts.RolesClaim = "roles"
+	}
+	return &JWTAuthenticator{opts: opts, keys: keys}
+}
+
+// SetKeys replaces the key set, e.g. to rotate keys
+func (a *JWTAuthenticator) SetKeys(keys ...JWTKey) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.keys = keys
+	a.jwksPath = ""
+}
+
+// LoadJWKS replaces the key set with the keys of a local JWKS file
+func (a *JWTAuthenticator) LoadJWKS(path string) error {
+	keys, err := readJWKS(path)
+	if err != nil {
+		return err
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.keys = keys
+	a.jwksPath = path
+	return nil
+}
+
+// Reload reads the JWKS file passed to LoadJWKS again, the old keys stay in use on error
+func (a *JWTAuthenticator) Reload() error {
+	a.mutex.RLock()
+	path := a.jwksPath
+	a.mutex.RUnlock()
+	if path == "" {
+		return errors.New("jwt: no JWKS file loaded")
+	}
+	return a.LoadJWKS(path)
+}
+
+// Authenticate reads the token from the request and verifies it
+func (a *JWTAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	token := a.requestToken(r)
+	if token == "" {
+		return nil, NewAuthError(http.StatusUnauthorized, "missing token")
+	}
+	principal, err := a.AuthenticateToken(token)
+	if err != nil {
+		return nil, NewAuthError(http.StatusUnauthorized, err.Error())
+	}
+	return principal, nil
+}
+
+// requestToken finds the token in the header, query parameter or subprotocols
+func (a *JWTAuthenticator) requestToken(r *http.Request) string {
+	if value := r.Header.Get(a.opts.Header); value != "" {
+		if len(value) > 7 && strings.EqualFold(value[:7], "Bearer ") {
+			return value[7:]
+		}
+	}
+	if token := r.URL.Query().Get(a.opts.QueryParam); token != "" {
+		return token
+	}
+	for _, value := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, protocol := range strings.Split(value, ",") {
+			protocol = strings.TrimSpace(protocol)
+			if strings.HasPrefix(protocol, a.opts.SubprotocolPrefix) {
+				return protocol[len(a.opts.SubprotocolPrefix):]
+			}
+		}
+	}
+	return ""
+}
+
+// AuthenticateToken verifies a token and returns its principal, it is also used for in-band refresh
+func (a *JWTAuthenticator) AuthenticateToken(token string) (*Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("jwt: malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("jwt: invalid header: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("jwt: invalid signature encoding: %w", err)
+	}
+	if !a.verify(header.Alg, header.Kid, parts[0]+"."+parts[1], signature) {
+		return nil, errors.New("jwt: invalid signature")
+	}
+
+	claims := make(map[string]interface{})
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("jwt: invalid claims: %w", err)
+	}
+	return a.principal(claims)
+}
+
+// verify checks the signature with the keys matching the algorithm and key ID.
+// The algorithm is bound to the key so that an RSA public key can never be used as an HMAC secret.
+func (a *JWTAuthenticator) verify(alg, kid, signingInput string, signature []byte) bool {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	digest := sha256.Sum256([]byte(signingInput))
+	for _, key := range a.keys {
+		if key.Algorithm != alg || (kid != "" && key.ID != "" && key.ID != kid) {
+			continue
+		}
+		switch k := key.Key.(type) {
+		case []byte:
+			mac := hmac.New(sha256.New, k)
+			mac.Write([]byte(signingInput))
+			if alg == JWTAlgHS256 && hmac.Equal(mac.Sum(nil), signature) {
+				return true
+			}
+		case *rsa.PublicKey:
+			if alg == JWTAlgRS256 && rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature) == nil {
+				return true
+			}
+		case *ecdsa.PublicKey:
+			if alg == JWTAlgES256 && len(signature) == 64 {
+				r := new(big.Int).SetBytes(signature[:32])
+				s := new(big.Int).SetBytes(signature[32:])
+				if ecdsa.Verify(k, digest[:], r, s) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// principal validates the registered claims and builds the principal
+func (a *JWTAuthenticator) principal(claims map[string]interface{}) (*Principal, error) {
+	now := time.Now()
+	principal := &Principal{Claims: claims}
+
+	if exp, ok := claims["exp"].(float64); ok {
+		// The connection lives as long as the token is accepted, including the leeway
+		principal.ExpiresAt = time.Unix(int64(exp), 0).Add(a.opts.Leeway)
+		if !now.Before(principal.ExpiresAt) {
+			return nil, errors.New("jwt: token expired")
+		}
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(a.opts.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("jwt: token not valid yet")
+	}
+	if a.opts.Issuer != "" && claims["iss"] != a.opts.Issuer {
+		return nil, errors.New("jwt: invalid issuer")
+	}
+	if a.opts.Audience != "" && !jwtAudience(claims["aud"], a.opts.Audience) {
+		return nil, errors.New("jwt: invalid audience")
+	}
+
+	principal.UserID, _ = claims["sub"].(string)
+	if principal.UserID == "" {
+		return nil, errors.New("jwt: missing subject")
+	}
+	switch roles := claims[a.opts.RolesClaim].(type) {
+	case []interface{}:
+		for _, role := range roles {
+			if s, ok := role.(string); ok {
+				principal.Roles = append(principal.Roles, s)
+			}
+		}
+	case string:
+		principal.Roles = strings.Fields(roles)
+	}
+	return principal, nil
+}
+
+// jwtAudience reports whether the "aud" claim, a string or a list, contains audience
+func jwtAudience(claim interface{}, audience string) bool {
+	switch aud := claim.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// readJWKS parses the oct, RSA and EC P-256 keys of a JWKS file, other keys are skipped
+func readJWKS(path string) ([]JWTKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("jwt: read JWKS: %w", err)
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Alg string `json:"alg"`
+			Use string `json:"use"`
+			K   string `json:"k"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("jwt: parse JWKS: %w", err)
+	}
+
+	var keys []JWTKey
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key := JWTKey{ID: jwk.Kid, Algorithm: jwk.Alg}
+		switch jwk.Kty {
+		case "oct":
+			secret, err := base64.RawURLEncoding.DecodeString(jwk.K)
+			if err != nil {
+				return nil, fmt.Errorf("jwt: key %q: %w", jwk.Kid, err)
+			}
+			key.Key = secret
+			if key.Algorithm == "" {
+				key.Algorithm = JWTAlgHS256
+			}
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+			e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+			if errN != nil || errE != nil {
+				return nil, fmt.Errorf("jwt: key %q: invalid RSA parameters", jwk.Kid)
+			}
+			key.Key = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+			if key.Algorithm == "" {
+				key.Algorithm = JWTAlgRS256
+			}
+		case "EC":
+			if jwk.Crv != "P-256" {
+				continue
+			}
+			x, errX := base64.RawURLEncoding.DecodeString(jwk.X)
+			y, errY := base64.RawURLEncoding.DecodeString(jwk.Y)
+			if errX != nil || errY != nil {
+				return nil, fmt.Errorf("jwt: key %q: invalid EC parameters", jwk.Kid)
+			}
+			key.Key = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			if key.Algorithm == "" {
+				key.Algorithm = JWTAlgES256
+			}
+		default:
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
@@ -0,0 +1,308 @@
+package pkg
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signHS256 builds an HS256 token with the claims
+func signHS256(t *testing.T, secret []byte, claims map[string]interface{}) string {
+	t.Helper()
+	return signJWT(t, JWTAlgHS256, "", secret, claims)
+}
+
+// signJWT builds a token signed with a []byte secret, an *rsa.PrivateKey or an *ecdsa.PrivateKey
+func signJWT(t *testing.T, alg, kid string, key interface{}, claims map[string]interface{}) string {
+	t.Helper()
+	header := map[string]string{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	headerJSON, _ := json.Marshal(header)
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("marshal claims: %v", err)
+	}
+	input := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var signature []byte
+	digest := sha256.Sum256([]byte(input))
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(input))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, digest[:])
+		if err == nil {
+			// JWS uses the fixed-size concatenation of r and s
+			signature = make([]byte, 64)
+			r.FillBytes(signature[:32])
+			s.FillBytes(signature[32:])
+		}
+	default:
+		t.Fatalf("unsupported key %T", key)
+	}
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// withSignature replaces the signature of a token
+func withSignature(token string, signature []byte) string {
+	return token[:strings.LastIndex(token, ".")+1] + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func generateKeys(t *testing.T) (*rsa.PrivateKey, *ecdsa.PrivateKey) {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate RSA key: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate EC key: %v", err)
+	}
+	return rsaKey, ecKey
+}
+
+func TestJWTLeewayExtendsExpiry(t *testing.T) {
+	secret := []byte("secret")
+	auth := NewJWTAuthenticator(JWTOptions{Leeway: time.Minute}, JWTKey{Algorithm: JWTAlgHS256, Key: secret})
+
+	// Expired 10 seconds ago but still within the leeway
+	exp := time.Now().Add(-10 * time.Second).Unix()
+	principal, err := auth.AuthenticateToken(signHS256(t, secret, map[string]interface{}{"sub": "alice", "exp": exp}))
+	if err != nil {
+		t.Fatalf("token within the leeway rejected: %v", err)
+	}
+	if want := time.Unix(exp, 0).Add(time.Minute); !principal.ExpiresAt.Equal(want) {
+		t.Fatalf("expires at %v, want %v", principal.ExpiresAt, want)
+	}
+	if !principal.ExpiresAt.After(time.Now()) {
+		t.Fatal("accepted principal has already expired")
+	}
+
+	exp = time.Now().Add(-2 * time.Minute).Unix()
+	if _, err := auth.AuthenticateToken(signHS256(t, secret, map[string]interface{}{"sub": "alice", "exp": exp})); err == nil {
+		t.Fatal("token expired past the leeway accepted")
+	}
+}
+
+func TestJWTAsymmetricAlgorithms(t *testing.T) {
+	rsaKey, ecKey := generateKeys(t)
+	otherRSA, otherEC := generateKeys(t)
+	claims := map[string]interface{}{"sub": "alice", "roles": []string{"admin"}}
+
+	for _, tc := range []struct {
+		name   string
+		alg    string
+		key    JWTKey
+		signer interface{}
+		other  interface{}
+	}{
+		{"RS256", JWTAlgRS256, JWTKey{Algorithm: JWTAlgRS256, Key: &rsaKey.PublicKey}, rsaKey, otherRSA},
+		{"ES256", JWTAlgES256, JWTKey{Algorithm: JWTAlgES256, Key: &ecKey.PublicKey}, ecKey, otherEC},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			auth := NewJWTAuthenticator(JWTOptions{}, tc.key)
+			principal, err := auth.AuthenticateToken(signJWT(t, tc.alg, "", tc.signer, claims))
+			if err != nil {
+				t.Fatalf("valid token rejected: %v", err)
+			}
+			if principal.UserID != "alice" || !principal.HasRole("admin") {
+				t.Fatalf("principal %+v, want alice with the admin role", principal)
+			}
+			if _, err := auth.AuthenticateToken(signJWT(t, tc.alg, "", tc.other, claims)); err == nil {
+				t.Fatal("token signed with another key accepted")
+			}
+		})
+	}
+}
+
+func TestJWTES256SignatureLength(t *testing.T) {
+	_, ecKey := generateKeys(t)
+	auth := NewJWTAuthenticator(JWTOptions{}, JWTKey{Algorithm: JWTAlgES256, Key: &ecKey.PublicKey})
+	token := signJWT(t, JWTAlgES256, "", ecKey, map[string]interface{}{"sub": "alice"})
+	signature, _ := base64.RawURLEncoding.DecodeString(token[strings.LastIndex(token, ".")+1:])
+
+	digest := sha256.Sum256([]byte(token[:strings.LastIndex(token, ".")]))
+	der, err := ecdsa.SignASN1(rand.Reader, ecKey, digest[:])
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	for name, malformed := range map[string][]byte{
+		"empty":     nil,
+		"truncated": signature[:63],
+		"padded":    append(append([]byte{}, signature...), 0),
+		"r only":    signature[:32],
+		"ASN.1 DER": der,
+	} {
+		if _, err := auth.AuthenticateToken(withSignature(token, malformed)); err == nil {
+			t.Errorf("%s signature accepted", name)
+		}
+	}
+}
+
+func TestJWTKeyID(t *testing.T) {
+	first, second := []byte("first"), []byte("second")
+	auth := NewJWTAuthenticator(JWTOptions{},
+		JWTKey{ID: "a", Algorithm: JWTAlgHS256, Key: first},
+		JWTKey{ID: "b", Algorithm: JWTAlgHS256, Key: second},
+	)
+	claims := map[string]interface{}{"sub": "alice"}
+
+	for _, tc := range []struct {
+		name   string
+		kid    string
+		secret []byte
+		valid  bool
+	}{
+		{"matching kid", "a", first, true},
+		{"second key", "b", second, true},
+		{"kid of another key", "b", first, false},
+		{"unknown kid", "c", first, false},
+		// Without a kid every key of the algorithm is tried
+		{"no kid", "", second, true},
+	} {
+		_, err := auth.AuthenticateToken(signJWT(t, JWTAlgHS256, tc.kid, tc.secret, claims))
+		if (err == nil) != tc.valid {
+			t.Errorf("%s: err = %v, valid %v", tc.name, err, tc.valid)
+		}
+	}
+
+	// A key without an ID matches any kid
+	auth.SetKeys(JWTKey{Algorithm: JWTAlgHS256, Key: first})
+	if _, err := auth.AuthenticateToken(signJWT(t, JWTAlgHS256, "c", first, claims)); err != nil {
+		t.Errorf("key without an ID rejected kid c: %v", err)
+	}
+}
+
+func TestJWTAlgorithmKeyMismatch(t *testing.T) {
+	rsaKey, ecKey := generateKeys(t)
+	publicDER, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatalf("marshal public key: %v", err)
+	}
+	secret := []byte("secret")
+	claims := map[string]interface{}{"sub": "alice"}
+
+	for _, tc := range []struct {
+		name  string
+		key   JWTKey
+		token string
+	}{
+		// The classic confusion attack: the RSA public key used as an HMAC secret
+		{"HS256 with the RSA public key", JWTKey{Algorithm: JWTAlgRS256, Key: &rsaKey.PublicKey}, signJWT(t, JWTAlgHS256, "", publicDER, claims)},
+		{"RS256 token for an ES256 key", JWTKey{Algorithm: JWTAlgES256, Key: &ecKey.PublicKey}, signJWT(t, JWTAlgRS256, "", rsaKey, claims)},
+		{"ES256 token for an RS256 key", JWTKey{Algorithm: JWTAlgRS256, Key: &rsaKey.PublicKey}, signJWT(t, JWTAlgES256, "", ecKey, claims)},
+		{"HS256 token for a secret labelled RS256", JWTKey{Algorithm: JWTAlgRS256, Key: secret}, signJWT(t, JWTAlgHS256, "", secret, claims)},
+		{"RS256 label on a secret", JWTKey{Algorithm: JWTAlgRS256, Key: secret}, withSignature(signJWT(t, JWTAlgRS256, "", rsaKey, claims), hmacSum(secret, signJWT(t, JWTAlgRS256, "", rsaKey, claims)))},
+		{"none", JWTKey{Algorithm: JWTAlgHS256, Key: secret}, withSignature(signJWT(t, "none", "", secret, claims), nil)},
+	} {
+		auth := NewJWTAuthenticator(JWTOptions{}, tc.key)
+		if _, err := auth.AuthenticateToken(tc.token); err == nil {
+			t.Errorf("%s: token accepted", tc.name)
+		}
+	}
+}
+
+// hmacSum signs the signing input of a token with an HMAC secret
+func hmacSum(secret []byte, token string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(token[:strings.LastIndex(token, ".")]))
+	return mac.Sum(nil)
+}
+
+func TestJWTLoadJWKSAndReload(t *testing.T) {
+	rsaKey, ecKey := generateKeys(t)
+	rotated, _ := generateKeys(t)
+	secret := []byte("shared-secret")
+	b64 := base64.RawURLEncoding.EncodeToString
+	rsaJWK := func(kid string, key *rsa.PrivateKey) map[string]string {
+		return map[string]string{"kty": "RSA", "kid": kid, "n": b64(key.N.Bytes()), "e": b64(big.NewInt(int64(key.E)).Bytes())}
+	}
+	writeJWKS := func(path string, keys ...map[string]string) {
+		t.Helper()
+		data, _ := json.Marshal(map[string]interface{}{"keys": keys})
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatalf("write JWKS: %v", err)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(path,
+		rsaJWK("rsa1", rsaKey),
+		map[string]string{"kty": "EC", "kid": "ec1", "crv": "P-256", "x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+		map[string]string{"kty": "oct", "kid": "hs1", "k": b64(secret)},
+		map[string]string{"kty": "RSA", "kid": "enc", "use": "enc", "n": b64(rotated.N.Bytes()), "e": "AQAB"},
+	)
+
+	auth := NewJWTAuthenticator(JWTOptions{})
+	if err := auth.Reload(); err == nil {
+		t.Fatal("Reload succeeded before LoadJWKS")
+	}
+	if err := auth.LoadJWKS(path); err != nil {
+		t.Fatalf("load JWKS: %v", err)
+	}
+
+	claims := map[string]interface{}{"sub": "alice"}
+	rsaToken := signJWT(t, JWTAlgRS256, "rsa1", rsaKey, claims)
+	for name, token := range map[string]string{
+		"RS256": rsaToken,
+		"ES256": signJWT(t, JWTAlgES256, "ec1", ecKey, claims),
+		"HS256": signJWT(t, JWTAlgHS256, "hs1", secret, claims),
+	} {
+		if _, err := auth.AuthenticateToken(token); err != nil {
+			t.Errorf("%s token rejected: %v", name, err)
+		}
+	}
+	if _, err := auth.AuthenticateToken(signJWT(t, JWTAlgRS256, "enc", rotated, claims)); err == nil {
+		t.Error("token verified with an encryption key")
+	}
+
+	// Rotate the keys in place
+	writeJWKS(path, rsaJWK("rsa2", rotated))
+	if err := auth.Reload(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if _, err := auth.AuthenticateToken(rsaToken); err == nil {
+		t.Error("token of a rotated out key accepted after Reload")
+	}
+	rotatedToken := signJWT(t, JWTAlgRS256, "rsa2", rotated, claims)
+	if _, err := auth.AuthenticateToken(rotatedToken); err != nil {
+		t.Errorf("token of the new key rejected: %v", err)
+	}
+
+	// A broken file keeps the loaded keys
+	os.WriteFile(path, []byte("{"), 0o600)
+	if err := auth.Reload(); err == nil {
+		t.Fatal("Reload accepted an invalid JWKS file")
+	}
+	if _, err := auth.AuthenticateToken(rotatedToken); err != nil {
+		t.Errorf("keys were dropped by a failed Reload: %v", err)
+	}
+
+	auth.SetKeys(JWTKey{Algorithm: JWTAlgHS256, Key: secret})
+	if err := auth.Reload(); err == nil {
+		t.Error("Reload succeeded after SetKeys replaced the JWKS keys")
+	}
+}
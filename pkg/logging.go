@@ -0,0 +1,105 @@
+package pkg
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"unicode/utf8"
+)
+
+// debugLogger is used for debug records when debug logging is enabled without a logger
+var debugLogger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+// SetLogger sets the logger of the manager, slog.Default() is used when it is nil.
+// Debug records are only emitted after EnableDebug and must also pass the logger's level.
+func (m *Manager) SetLogger(logger *slog.Logger) {
+	m.logger = logger
+}
+
+// SetPayloadLogLimit sets how many bytes of message payloads debug records include.
+// Payloads are redacted to their size with the default limit of 0, a negative limit logs them in full.
+func (m *Manager) SetPayloadLogLimit(limit int) {
+	m.payloadLogLimit = limit
+}
+
+// EnableDebug enables debug logging
+func (m *Manager) EnableDebug() {
+	m.debug = true
+}
+
+// DisableDebug disables debug logging
+func (m *Manager) DisableDebug() {
+	m.debug = false
+}
+
+// log returns the logger for records of any level
+func (m *Manager) log() *slog.Logger {
+	if m.logger != nil {
+		return m.logger
+	}
+	if m.debug {
+		return debugLogger
+	}
+	return slog.Default()
+}
+
+// debugLog emits a debug record if debug is enabled
+func (m *Manager) debugLog(msg string, args ...any) {
+	if m.debug {
+		m.log().Debug(msg, args...)
+	}
+}
+
+// payloadArgs returns the log attributes of a message payload, capped or
+// redacted according to the payload log limit
+func (m *Manager) payloadArgs(payload []byte) []any {
+	args := []any{"payload_size", len(payload)}
+	switch limit := m.payloadLogLimit; {
+	case limit < 0 || (limit > 0 && len(payload) <= limit):
+		args = append(args, "payload", string(payload))
+	case limit > 0:
+		cut := payload[:limit]
+		// Do not split a multi-byte character
+		for len(cut) > 0 && !utf8.Valid(cut) {
+			cut = cut[:len(cut)-1]
+		}
+		args = append(args, "payload", string(cut)+"...")
+	}
+	return args
+}
+
+// logArgs prefixes args with the attributes identifying the client
+func (c *Client) logArgs(args ...any) []any {
+	return append([]any{
+		"client_id", c.id,
+		"user_id", c.userID,
+		"remote_addr", c.conn.RemoteAddr().String(),
+	}, args...)
+}
+
+// errorLevel returns the level error events with a code are logged at. Failures of the
+// server are errors, lost messages and connections warnings, and client mistakes debug records.
+func errorLevel(code int) slog.Level {
+	switch code {
+	case 1001, 1013, 1016:
+		return slog.LevelError
+	case 1002, 1004, 1005, 1011, 1012, 1017:
+		return slog.LevelWarn
+	default:
+		return slog.LevelDebug
+	}
+}
+
+// logError logs an error event with its code and client, args add details such
+// as the underlying error
+func (m *Manager) logError(event *ErrorEvent, args ...any) {
+	level := errorLevel(event.Code)
+	if level == slog.LevelDebug && !m.debug {
+		return
+	}
+	args = append([]any{"code", event.Code}, args...)
+	if event.Client != nil {
+		args = event.Client.logArgs(args...)
+	}
+	m.log().Log(context.Background(), level, event.Message, args...)
+}
@@ -0,0 +1,90 @@
+package pkg
+
+import "sync"
+
+// MemoryBus connects managers within one process, mainly for testing clustered behavior
+type MemoryBus struct {
+	mutex sync.RWMutex
+	nodes map[*memoryBroker]bool
+}
+
+// NewMemoryBus creates an in-process message bus
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{nodes: make(map[*memoryBroker]bool)}
+}
+
+// NewBroker creates a broker attached to the bus, one per manager
+func (b *MemoryBus) NewBroker() Broker {
+	return &memoryBroker{bus: b, filters: make(map[string]bool)}
+}
+
+// memoryBroker is one node's connection to a MemoryBus
+type memoryBroker struct {
+	bus     *MemoryBus
+	nodeID  string
+	handler func(msg *BrokerMessage)
+	filters map[string]bool // Guarded by bus.mutex
+}
+
+// Start attaches the node to the bus
+func (b *memoryBroker) Start(nodeID string, handler func(msg *BrokerMessage)) error {
+	b.bus.mutex.Lock()
+	defer b.bus.mutex.Unlock()
+	b.nodeID = nodeID
+	b.handler = handler
+	b.bus.nodes[b] = true
+	return nil
+}
+
+// Publish delivers the message synchronously to every node interested in it
+func (b *memoryBroker) Publish(msg *BrokerMessage) error {
+	b.bus.mutex.RLock()
+	var targets []func(msg *BrokerMessage)
+	for node := range b.bus.nodes {
+		if msg.Kind != BrokerTopic || node.interestedIn(msg.Topic) {
+			targets = append(targets, node.handler)
+		}
+	}
+	b.bus.mutex.RUnlock()
+
+	for _, handler := range targets {
+		copied := *msg
+		handler(&copied)
+	}
+	return nil
+}
+
+// interestedIn reports whether a node subscribed to a filter matching the topic,
+// the caller must hold bus.mutex
+func (b *memoryBroker) interestedIn(topic string) bool {
+	for filter := range b.filters {
+		if TopicMatches(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscribe registers interest in a topic filter
+func (b *memoryBroker) Subscribe(filter string) error {
+	b.bus.mutex.Lock()
+	defer b.bus.mutex.Unlock()
+	b.filters[filter] = true
+	return nil
+}
+
+// Unsubscribe drops interest in a topic filter
+func (b *memoryBroker) Unsubscribe(filter string) error {
+	b.bus.mutex.Lock()
+	defer b.bus.mutex.Unlock()
+	delete(b.filters, filter)
+	return nil
+}
+
+// Close detaches the node from the bus
+func (b *memoryBroker) Close() error {
+	b.bus.mutex.Lock()
+	defer b.bus.mutex.Unlock()
+	delete(b.bus.nodes, b)
+	return nil
+}
@@ -0,0 +1,224 @@
+package pkg
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Disconnect reasons used as the reason label of tkws_disconnects_total
+const (
+	disconnectClientClosed = "client_closed"
+	disconnectHeartbeat    = "heartbeat_timeout"
+	disconnectReadError    = "read_error"
+	disconnectWriteError   = "write_error"
+	disconnectSlowConsumer = "slow_consumer"
+	disconnectTokenExpired = "token_expired"
+	disconnectKicked       = "kicked"
+	disconnectShutdown     = "shutdown"
+)
+
+// sendDepthBuckets are the upper bounds of the send buffer depth histogram
+var sendDepthBuckets = []int{0, 1, 2, 4, 8, 16, 32, 64, 128, 256, 512}
+
+// metrics holds the counters exposed by MetricsHandler
+type metrics struct {
+	connects          atomic.Uint64
+	messagesIn        atomic.Uint64
+	messagesOut       atomic.Uint64
+	bytesIn           atomic.Uint64
+	bytesOut          atomic.Uint64
+	dropped           atomic.Uint64
+	heartbeatFailures atomic.Uint64
+
+	depthBuckets []atomic.Uint64 // One per bucket plus +Inf, not cumulative
+	depthSum     atomic.Uint64
+
+	mu          sync.Mutex
+	disconnects map[string]uint64
+	errors      map[int]uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		depthBuckets: make([]atomic.Uint64, len(sendDepthBuckets)+1),
+		disconnects:  make(map[string]uint64),
+		errors:       make(map[int]uint64),
+	}
+}
+
+func (s *metrics) disconnected(reason string, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.disconnects[reason] += uint64(n)
+}
+
+func (s *metrics) errored(code int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errors[code]++
+}
+
+func (s *metrics) received(size int) {
+	s.messagesIn.Add(1)
+	s.bytesIn.Add(uint64(size))
+}
+
+func (s *metrics) sent(size int) {
+	s.messagesOut.Add(1)
+	s.bytesOut.Add(uint64(size))
+}
+
+// observeDepth records the send buffer depth after a frame was queued
+func (s *metrics) observeDepth(depth int) {
+	i := sort.SearchInts(sendDepthBuckets, depth)
+	s.depthBuckets[i].Add(1)
+	s.depthSum.Add(uint64(depth))
+}
+
+// reportError counts and logs an error event and sends it on the Errors channel,
+// args add log attributes such as the underlying error. It is called with the manager
+// mutex held, so events are discarded rather than waited on when the channel is full.
+func (m *Manager) reportError(event *ErrorEvent, args ...any) {
+	m.metrics.errored(event.Code)
+	m.logError(event, args...)
+	select {
+	case m.Errors <- event:
+	default:
+	}
+}
+
+// setLeaveReason records why the client is going away, the first reason wins
+func (c *Client) setLeaveReason(reason string) {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	c.setLeaveReasonLocked(reason)
+}
+
+func (c *Client) setLeaveReasonLocked(reason string) {
+	if c.leaveReason == "" {
+		c.leaveReason = reason
+	}
+}
+
+// disconnectReason gets the recorded leave reason, connections closed without
+// one were closed by the client
+func (c *Client) disconnectReason() string {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	if c.leaveReason == "" {
+		return disconnectClientClosed
+	}
+	return c.leaveReason
+}
+
+// MetricsHandler serves the manager's metrics in the Prometheus text exposition format
+func (m *Manager) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		bw := bufio.NewWriter(w)
+		m.writeMetrics(bw)
+		bw.Flush()
+	})
+}
+
+func (m *Manager) writeMetrics(w *bufio.Writer) {
+	s := m.metrics
+
+	m.mutex.Lock()
+	active := len(m.Clients)
+	topics := make(map[string]int, len(m.Topics))
+	for topic, clients := range m.Topics {
+		if len(clients) > 0 {
+			topics[topic] = len(clients)
+		}
+	}
+	m.mutex.Unlock()
+
+	s.mu.Lock()
+	disconnects := make(map[string]uint64, len(s.disconnects))
+	for reason, n := range s.disconnects {
+		disconnects[reason] = n
+	}
+	errs := make(map[int]uint64, len(s.errors))
+	for code, n := range s.errors {
+		errs[code] = n
+	}
+	s.mu.Unlock()
+
+	writeMetricHeader(w, "tkws_connections_active", "gauge", "Number of connected clients.")
+	fmt.Fprintf(w, "tkws_connections_active %d\n", active)
+
+	writeMetricHeader(w, "tkws_connects_total", "counter", "Total number of accepted connections.")
+	fmt.Fprintf(w, "tkws_connects_total %d\n", s.connects.Load())
+
+	writeMetricHeader(w, "tkws_disconnects_total", "counter", "Total number of disconnections by reason.")
+	for _, reason := range sortedKeys(disconnects) {
+		fmt.Fprintf(w, "tkws_disconnects_total{reason=\"%s\"} %d\n", escapeLabel(reason), disconnects[reason])
+	}
+
+	writeMetricHeader(w, "tkws_topic_subscribers", "gauge", "Number of local subscribers per topic filter.")
+	for _, topic := range sortedKeys(topics) {
+		fmt.Fprintf(w, "tkws_topic_subscribers{topic=\"%s\"} %d\n", escapeLabel(topic), topics[topic])
+	}
+
+	writeMetricHeader(w, "tkws_messages_received_total", "counter", "Total number of frames received from clients.")
+	fmt.Fprintf(w, "tkws_messages_received_total %d\n", s.messagesIn.Load())
+	writeMetricHeader(w, "tkws_messages_sent_total", "counter", "Total number of frames sent to clients.")
+	fmt.Fprintf(w, "tkws_messages_sent_total %d\n", s.messagesOut.Load())
+	writeMetricHeader(w, "tkws_received_bytes_total", "counter", "Total number of payload bytes received from clients.")
+	fmt.Fprintf(w, "tkws_received_bytes_total %d\n", s.bytesIn.Load())
+	writeMetricHeader(w, "tkws_sent_bytes_total", "counter", "Total number of payload bytes sent to clients.")
+	fmt.Fprintf(w, "tkws_sent_bytes_total %d\n", s.bytesOut.Load())
+
+	writeMetricHeader(w, "tkws_dropped_messages_total", "counter", "Total number of frames dropped for slow consumers.")
+	fmt.Fprintf(w, "tkws_dropped_messages_total %d\n", s.dropped.Load())
+
+	writeMetricHeader(w, "tkws_send_buffer_depth", "histogram", "Send buffer depth observed when a frame is queued.")
+	var cumulative uint64
+	for i, bound := range sendDepthBuckets {
+		cumulative += s.depthBuckets[i].Load()
+		fmt.Fprintf(w, "tkws_send_buffer_depth_bucket{le=\"%d\"} %d\n", bound, cumulative)
+	}
+	cumulative += s.depthBuckets[len(sendDepthBuckets)].Load()
+	fmt.Fprintf(w, "tkws_send_buffer_depth_bucket{le=\"+Inf\"} %d\n", cumulative)
+	fmt.Fprintf(w, "tkws_send_buffer_depth_sum %d\n", s.depthSum.Load())
+	fmt.Fprintf(w, "tkws_send_buffer_depth_count %d\n", cumulative)
+
+	writeMetricHeader(w, "tkws_heartbeat_failures_total", "counter", "Total number of heartbeat timeouts and failed heartbeats.")
+	fmt.Fprintf(w, "tkws_heartbeat_failures_total %d\n", s.heartbeatFailures.Load())
+
+	writeMetricHeader(w, "tkws_errors_total", "counter", "Total number of error events by code.")
+	codes := make([]int, 0, len(errs))
+	for code := range errs {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Fprintf(w, "tkws_errors_total{code=\"%d\"} %d\n", code, errs[code])
+	}
+}
+
+func writeMetricHeader(w *bufio.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeLabel escapes a label value for the text exposition format
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
@@ -0,0 +1,135 @@
+package pkg
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scrapeMetrics reads the metrics endpoint into values by series
+func scrapeMetrics(t *testing.T, m *Manager) map[string]float64 {
+	t.Helper()
+	w := httptest.NewRecorder()
+	m.MetricsHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("metrics answered %d with %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	values := make(map[string]float64)
+	for _, line := range strings.Split(strings.TrimSpace(w.Body.String()), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("invalid metric line %q", line)
+		}
+		values[line[:i]] = value
+	}
+	return values
+}
+
+func TestReportErrorDoesNotBlockWhenFull(t *testing.T) {
+	m := NewManager()
+	for i := 0; i < cap(m.Errors); i++ {
+		m.Errors <- &ErrorEvent{Code: 1001}
+	}
+
+	reported := make(chan struct{})
+	go func() {
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		m.reportError(&ErrorEvent{Message: "overflow", Code: 1012, Time: time.Now()})
+		close(reported)
+	}()
+	select {
+	case <-reported:
+	case <-time.After(time.Second):
+		t.Fatal("reportError blocked on a full Errors channel")
+	}
+	if len(m.Errors) != cap(m.Errors) {
+		t.Fatalf("Errors holds %d events, want %d", len(m.Errors), cap(m.Errors))
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	m, _, url := startTestManager(t)
+	conn := dialTest(t, url)
+	subscribeTest(t, conn, "news")
+	conn.WriteJSON(map[string]interface{}{"op": OpSubscribe, "id": "bad", "topic": "news/#/x"})
+	readFrame(t, conn, func(frame map[string]interface{}) bool { return frame["op"] == OpError })
+	// The error is counted after the reply was queued
+	waitError(t, m, 1010)
+
+	before := scrapeMetrics(t, m)
+	for series, want := range map[string]float64{
+		"tkws_connections_active":                  1,
+		"tkws_connects_total":                      1,
+		`tkws_topic_subscribers{topic="news"}`:     1,
+		`tkws_errors_total{code="1010"}`:           1,
+		"tkws_dropped_messages_total":              0,
+		"tkws_messages_received_total":             2,
+		`tkws_send_buffer_depth_bucket{le="+Inf"}`: before["tkws_send_buffer_depth_count"],
+	} {
+		if got, ok := before[series]; !ok || got != want {
+			t.Errorf("%s = %v, want %v", series, got, want)
+		}
+	}
+
+	// A pumpless client with room for two frames observes depths 1 and 2, then drops one
+	client := newPumplessClient(t, m, 2, SlowConsumerPolicy{Action: SlowConsumerDropNewest})
+	for i := 0; i < 3; i++ {
+		client.enqueue([]byte("frame"))
+	}
+	conn.Close()
+	waitDisconnected(t, m)
+
+	after := scrapeMetrics(t, m)
+	delta := func(series string) float64 { return after[series] - before[series] }
+	if got := delta("tkws_dropped_messages_total"); got != 1 {
+		t.Errorf("dropped grew by %v, want 1", got)
+	}
+	if got := after[`tkws_disconnects_total{reason="client_closed"}`]; got != 1 {
+		t.Errorf("client_closed disconnects = %v, want 1", got)
+	}
+	if got := after["tkws_connections_active"]; got != 0 {
+		t.Errorf("active connections = %v, want 0", got)
+	}
+	if _, ok := after[`tkws_topic_subscribers{topic="news"}`]; ok {
+		t.Error("news still has subscribers after the disconnect")
+	}
+
+	// Buckets are cumulative
+	wantBuckets := map[string]float64{"0": 0, "1": 1, "2": 2, "4": 2, "512": 2, "+Inf": 2}
+	for le, want := range wantBuckets {
+		if got := delta(fmt.Sprintf("tkws_send_buffer_depth_bucket{le=%q}", le)); got != want {
+			t.Errorf("bucket le=%s grew by %v, want %v", le, got, want)
+		}
+	}
+	if got := delta("tkws_send_buffer_depth_sum"); got != 3 {
+		t.Errorf("depth sum grew by %v, want 3", got)
+	}
+	if got := delta("tkws_send_buffer_depth_count"); got != 2 {
+		t.Errorf("depth count grew by %v, want 2", got)
+	}
+	previous := -1.0
+	for _, le := range append(sendDepthBucketLabels(), "+Inf") {
+		count := after[fmt.Sprintf("tkws_send_buffer_depth_bucket{le=%q}", le)]
+		if count < previous {
+			t.Errorf("bucket le=%s holds %v, less than the bucket below it", le, count)
+		}
+		previous = count
+	}
+}
+
+func sendDepthBucketLabels() []string {
+	labels := make([]string, len(sendDepthBuckets))
+	for i, bound := range sendDepthBuckets {
+		labels[i] = strconv.Itoa(bound)
+	}
+	return labels
+}
@@ -0,0 +1,342 @@
+// Package natsbroker relays tank-websocket cluster traffic through NATS, optionally
+// storing topic messages in JetStream so history and replay survive node restarts.
+package natsbroker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	tkws "github.com/fanqie/tank-websocket-go-server/pkg"
+	"github.com/nats-io/nats.go"
+)
+
+// Options configures the NATS broker
+type Options struct {
+	// Prefix is the first subject token, defaults to "tkws"
+	Prefix string
+
+	// JetStream stores topic messages in a stream and uses its sequence numbers
+	JetStream bool
+	// Stream is the JetStream stream name, defaults to "TKWS"
+	Stream string
+	// HistorySize is the number of messages kept per topic, defaults to 100
+	HistorySize int64
+	// MaxAge discards stored messages older than this, zero keeps them
+	MaxAge time.Duration
+	// Replicas is the stream replication factor, defaults to 1
+	Replicas int
+	// Storage defaults to file storage
+	Storage nats.StorageType
+}
+
+// Broker implements tkws.HistoryBroker on top of NATS.
+// Manager topics map to subjects by level, "game/room1" is published on
+// "tkws.topic.game.room1" and the filter "game/+" subscribes to "tkws.topic.game.*".
+type Broker struct {
+	conn *nats.Conn
+	js   nats.JetStreamContext
+	opts Options
+
+	mutex   sync.Mutex
+	handler func(msg *tkws.BrokerMessage)
+	subs    []*nats.Subscription            // Broadcast, direct and close subscriptions
+	filters map[string][]*nats.Subscription // Topic subscriptions by filter
+}
+
+// New creates a NATS broker using an existing connection. The connection reconnects and
+// resubscribes on its own, create it with nats.MaxReconnects(-1) to retry forever.
+func New(conn *nats.Conn, opts Options) *Broker {
+	if opts.Prefix == "" {
+		opts.Prefix = "tkws"
+	}
+	if opts.Stream == "" {
+		opts.Stream = "TKWS"
+	}
+	if opts.HistorySize <= 0 {
+		opts.HistorySize = 100
+	}
+	if opts.Replicas <= 0 {
+		opts.Replicas = 1
+	}
+	return &Broker{
+		conn:    conn,
+		opts:    opts,
+		filters: make(map[string][]*nats.Subscription),
+	}
+}
+
+// Start creates the JetStream stream if enabled and subscribes to the broadcast, direct and close subjects
+func (b *Broker) Start(nodeID string, handler func(msg *tkws.BrokerMessage)) error {
+	if b.opts.JetStream {
+		if err := b.ensureStream(); err != nil {
+			return err
+		}
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.handler = handler
+	for _, kind := range []string{tkws.BrokerBroadcast, tkws.BrokerUser, tkws.BrokerClose} {
+		sub, err := b.conn.Subscribe(b.opts.Prefix+"."+kind, b.receive)
+		if err != nil {
+			return fmt.Errorf("nats subscribe: %w", err)
+		}
+		b.subs = append(b.subs, sub)
+	}
+	// Make sure the server registered the subscriptions before messages are published
+	return b.conn.Flush()
+}
+
+// ensureStream creates the topic stream unless it already exists
+func (b *Broker) ensureStream() error {
+	js, err := b.conn.JetStream()
+	if err != nil {
+		return fmt.Errorf("jetstream: %w", err)
+	}
+	b.js = js
+
+	_, err = js.StreamInfo(b.opts.Stream)
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		_, err = js.AddStream(&nats.StreamConfig{
+			Name:              b.opts.Stream,
+			Subjects:          []string{b.opts.Prefix + ".topic.>"},
+			Storage:           b.opts.Storage,
+			Replicas:          b.opts.Replicas,
+			MaxMsgsPerSubject: b.opts.HistorySize,
+			MaxAge:            b.opts.MaxAge,
+			Duplicates:        time.Minute,
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("jetstream stream %s: %w", b.opts.Stream, err)
+	}
+	return nil
+}
+
+// receive decodes a message and hands it to the manager
+func (b *Broker) receive(m *nats.Msg) {
+	var msg tkws.BrokerMessage
+	if err := json.Unmarshal(m.Data, &msg); err != nil {
+		return
+	}
+	if msg.Kind == tkws.BrokerTopic && msg.Message != nil && b.js != nil {
+		// The payload was encoded before JetStream assigned the sequence number
+		if meta, err := m.Metadata(); err == nil {
+			msg.Message.Seq = meta.Sequence.Stream
+		}
+	}
+
+	b.mutex.Lock()
+	handler := b.handler
+	b.mutex.Unlock()
+	if handler != nil {
+		handler(&msg)
+	}
+}
+
+// Publish sends a message to every node, topic messages are stored when JetStream is enabled
+func (b *Broker) Publish(msg *tkws.BrokerMessage) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if msg.Kind != tkws.BrokerTopic {
+		return b.conn.Publish(b.opts.Prefix+"."+msg.Kind, payload)
+	}
+
+	subject := b.topicSubject(msg.Topic)
+	if b.js == nil {
+		return b.conn.Publish(subject, payload)
+	}
+	ack, err := b.js.Publish(subject, payload, nats.MsgId(msg.ID))
+	if err != nil {
+		return err
+	}
+	if msg.Message != nil {
+		msg.Message.Seq = ack.Sequence
+	}
+	return nil
+}
+
+// Subscribe listens on the subjects of a topic filter. With JetStream an ordered consumer
+// delivers new messages together with their stream sequence.
+func (b *Broker) Subscribe(filter string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if _, ok := b.filters[filter]; ok {
+		return nil
+	}
+
+	var subs []*nats.Subscription
+	for _, subject := range b.filterSubjects(filter) {
+		var (
+			sub *nats.Subscription
+			err error
+		)
+		if b.js != nil {
+			sub, err = b.js.Subscribe(subject, b.receive, nats.OrderedConsumer(), nats.DeliverNew())
+		} else {
+			sub, err = b.conn.Subscribe(subject, b.receive)
+		}
+		if err != nil {
+			unsubscribeAll(subs)
+			return fmt.Errorf("nats subscribe %s: %w", subject, err)
+		}
+		subs = append(subs, sub)
+	}
+	b.filters[filter] = subs
+	// Make sure the server registered the subscriptions before Subscribe returns
+	return b.conn.Flush()
+}
+
+// Unsubscribe stops listening for a topic filter
+func (b *Broker) Unsubscribe(filter string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	err := unsubscribeAll(b.filters[filter])
+	delete(b.filters, filter)
+	return err
+}
+
+// History reads the stored messages of a filter from JetStream
+func (b *Broker) History(filter string, sinceSeq uint64, since time.Time) ([]*tkws.TopicResponse, error) {
+	if b.js == nil {
+		return nil, fmt.Errorf("nats broker: JetStream is not enabled")
+	}
+
+	var messages []*tkws.TopicResponse
+	for _, subject := range b.filterSubjects(filter) {
+		stored, err := b.history(subject, sinceSeq, since)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, stored...)
+	}
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].Seq < messages[j].Seq
+	})
+	return messages, nil
+}
+
+// history fetches the stored messages of one subject with a temporary pull consumer
+func (b *Broker) history(subject string, sinceSeq uint64, since time.Time) ([]*tkws.TopicResponse, error) {
+	start := nats.DeliverAll()
+	if sinceSeq > 0 {
+		start = nats.StartSequence(sinceSeq + 1)
+	} else if !since.IsZero() {
+		start = nats.StartTime(since)
+	}
+
+	sub, err := b.js.PullSubscribe(subject, "", start, nats.AckNone(), nats.BindStream(b.opts.Stream))
+	if err != nil {
+		return nil, fmt.Errorf("nats history %s: %w", subject, err)
+	}
+	defer sub.Unsubscribe()
+
+	info, err := sub.ConsumerInfo()
+	if err != nil {
+		return nil, fmt.Errorf("nats history %s: %w", subject, err)
+	}
+
+	var messages []*tkws.TopicResponse
+	for remaining := int(info.NumPending); remaining > 0; {
+		batch, err := sub.Fetch(remaining, nats.MaxWait(5*time.Second))
+		if err != nil {
+			return nil, fmt.Errorf("nats history %s: %w", subject, err)
+		}
+		remaining -= len(batch)
+
+		for _, m := range batch {
+			meta, err := m.Metadata()
+			if err != nil || meta.Timestamp.Before(since) {
+				continue
+			}
+			var msg tkws.BrokerMessage
+			if err := json.Unmarshal(m.Data, &msg); err != nil || msg.Message == nil {
+				continue
+			}
+			msg.Message.Seq = meta.Sequence.Stream
+			messages = append(messages, msg.Message)
+		}
+	}
+	return messages, nil
+}
+
+// Close removes all subscriptions, the NATS connection is left open for its owner
+func (b *Broker) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	err := unsubscribeAll(b.subs)
+	for filter, subs := range b.filters {
+		if unsubErr := unsubscribeAll(subs); err == nil {
+			err = unsubErr
+		}
+		delete(b.filters, filter)
+	}
+	b.subs = nil
+	b.handler = nil
+	return err
+}
+
+func unsubscribeAll(subs []*nats.Subscription) error {
+	var err error
+	for _, sub := range subs {
+		if unsubErr := sub.Unsubscribe(); err == nil {
+			err = unsubErr
+		}
+	}
+	return err
+}
+
+// topicSubject maps a topic to its subject, one token per level
+func (b *Broker) topicSubject(topic string) string {
+	levels := strings.Split(topic, "/")
+	for i, level := range levels {
+		levels[i] = subjectToken(level)
+	}
+	return b.opts.Prefix + ".topic." + strings.Join(levels, ".")
+}
+
+// filterSubjects maps a topic filter to subjects, "+" becomes "*" and "#" becomes ">".
+// "#" also matches the parent level, so "game/#" needs both "game" and "game.>".
+func (b *Broker) filterSubjects(filter string) []string {
+	base := b.opts.Prefix + ".topic"
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		switch level {
+		case "+":
+			levels[i] = "*"
+		case "#":
+			if i == 0 {
+				return []string{base + ".>"}
+			}
+			parent := base + "." + strings.Join(levels[:i], ".")
+			return []string{parent, parent + ".>"}
+		default:
+			levels[i] = subjectToken(level)
+		}
+	}
+	return []string{base + "." + strings.Join(levels, ".")}
+}
+
+// subjectToken percent-encodes the characters NATS reserves in subject tokens,
+// empty levels become "%" which no encoded level can collide with
+func subjectToken(level string) string {
+	if level == "" {
+		return "%"
+	}
+	var sb strings.Builder
+	for _, r := range level {
+		if strings.ContainsRune("%.*> \t\r\n", r) {
+			fmt.Fprintf(&sb, "%%%02X", r)
+			continue
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
@@ -0,0 +1,235 @@
+package natsbroker
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	tkws "github.com/fanqie/tank-websocket-go-server/pkg"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+// runServer starts an embedded NATS server with JetStream storing into dir, it is
+// shut down after the brokers and connections of the test are closed
+func runServer(t *testing.T, dir string) *server.Server {
+	t.Helper()
+	s, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, JetStream: true, StoreDir: dir})
+	if err != nil {
+		t.Fatalf("nats server: %v", err)
+	}
+	s.Start()
+	if !s.ReadyForConnections(5 * time.Second) {
+		s.Shutdown()
+		t.Fatal("nats server not ready")
+	}
+	t.Cleanup(s.Shutdown)
+	return s
+}
+
+// startBroker connects a broker to s, received messages are sent on the returned channel
+func startBroker(t *testing.T, s *server.Server, nodeID string, opts Options) (*Broker, chan *tkws.BrokerMessage) {
+	t.Helper()
+	conn, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatalf("nats connect: %v", err)
+	}
+	t.Cleanup(conn.Close)
+
+	received := make(chan *tkws.BrokerMessage, 16)
+	b := New(conn, opts)
+	if err := b.Start(nodeID, func(msg *tkws.BrokerMessage) { received <- msg }); err != nil {
+		t.Fatalf("start broker: %v", err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b, received
+}
+
+func receive(t *testing.T, received chan *tkws.BrokerMessage) *tkws.BrokerMessage {
+	t.Helper()
+	select {
+	case msg := <-received:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+		return nil
+	}
+}
+
+func expectNone(t *testing.T, received chan *tkws.BrokerMessage) {
+	t.Helper()
+	select {
+	case msg := <-received:
+		t.Fatalf("unexpected message %+v", msg)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func topicMessage(id, topic, data string) *tkws.BrokerMessage {
+	return &tkws.BrokerMessage{
+		ID:      id,
+		Kind:    tkws.BrokerTopic,
+		NodeID:  "a",
+		Topic:   topic,
+		Message: &tkws.TopicResponse{ID: id, Topic: topic, Data: data},
+	}
+}
+
+func TestTopicFanOut(t *testing.T) {
+	for name, jetStream := range map[string]bool{"core": false, "jetstream": true} {
+		t.Run(name, func(t *testing.T) {
+			s := runServer(t, t.TempDir())
+
+			a, _ := startBroker(t, s, "a", Options{JetStream: jetStream})
+			b, received := startBroker(t, s, "b", Options{JetStream: jetStream})
+			for _, filter := range []string{"game/+", "chat/#"} {
+				if err := b.Subscribe(filter); err != nil {
+					t.Fatalf("subscribe %s: %v", filter, err)
+				}
+			}
+
+			for i, topic := range []string{"game/room1", "chat", "chat/lobby/en", "other/room1"} {
+				if err := a.Publish(topicMessage(string(rune('1'+i)), topic, topic)); err != nil {
+					t.Fatalf("publish %s: %v", topic, err)
+				}
+			}
+			got := make(map[string]bool)
+			for i := 0; i < 3; i++ {
+				msg := receive(t, received)
+				if msg.Message.Data != msg.Topic || msg.NodeID != "a" {
+					t.Fatalf("got %+v", msg)
+				}
+				if jetStream && msg.Message.Seq == 0 {
+					t.Fatalf("message %s has no stream sequence", msg.Topic)
+				}
+				got[msg.Topic] = true
+			}
+			want := map[string]bool{"game/room1": true, "chat": true, "chat/lobby/en": true}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("received %v, want %v", got, want)
+			}
+			expectNone(t, received)
+		})
+	}
+}
+
+func TestBroadcastAndUser(t *testing.T) {
+	s := runServer(t, t.TempDir())
+
+	a, _ := startBroker(t, s, "a", Options{})
+	_, received := startBroker(t, s, "b", Options{})
+
+	a.Publish(&tkws.BrokerMessage{ID: "1", Kind: tkws.BrokerBroadcast, NodeID: "a", Data: []byte("hello")})
+	a.Publish(&tkws.BrokerMessage{ID: "2", Kind: tkws.BrokerUser, NodeID: "a", UserID: "u1", Data: []byte("direct")})
+
+	got := make(map[string]string)
+	for i := 0; i < 2; i++ {
+		msg := receive(t, received)
+		got[msg.Kind] = msg.UserID + ":" + string(msg.Data)
+	}
+	want := map[string]string{tkws.BrokerBroadcast: ":hello", tkws.BrokerUser: "u1:direct"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("received %v, want %v", got, want)
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	s := runServer(t, t.TempDir())
+
+	a, _ := startBroker(t, s, "a", Options{})
+	b, received := startBroker(t, s, "b", Options{})
+	b.Subscribe("game/+")
+	a.Publish(topicMessage("1", "game/room1", "first"))
+	receive(t, received)
+
+	if err := b.Unsubscribe("game/+"); err != nil {
+		t.Fatalf("unsubscribe: %v", err)
+	}
+	a.Publish(topicMessage("2", "game/room1", "second"))
+	expectNone(t, received)
+}
+
+func TestFilterSubjects(t *testing.T) {
+	b := New(nil, Options{})
+	tests := []struct {
+		filter string
+		want   []string
+	}{
+		{"game/room1", []string{"tkws.topic.game.room1"}},
+		{"game/+", []string{"tkws.topic.game.*"}},
+		{"+/room1", []string{"tkws.topic.*.room1"}},
+		{"game/#", []string{"tkws.topic.game", "tkws.topic.game.>"}},
+		{"game/+/#", []string{"tkws.topic.game.*", "tkws.topic.game.*.>"}},
+		{"#", []string{"tkws.topic.>"}},
+		{"a.b/c*", []string{"tkws.topic.a%2Eb.c%2A"}},
+		{"game//x", []string{"tkws.topic.game.%.x"}},
+	}
+	for _, test := range tests {
+		if got := b.filterSubjects(test.filter); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("filterSubjects(%q) = %v, want %v", test.filter, got, test.want)
+		}
+	}
+	if got, want := b.topicSubject("game/room1"), "tkws.topic.game.room1"; got != want {
+		t.Errorf("topicSubject = %q, want %q", got, want)
+	}
+}
+
+func TestHistoryAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{JetStream: true, HistorySize: 10}
+
+	s := runServer(t, dir)
+	a, _ := startBroker(t, s, "a", opts)
+	var seqs []uint64
+	var middle time.Time
+	for i, topic := range []string{"game/room1", "game", "game/room2", "chat/lobby"} {
+		if i == 2 {
+			time.Sleep(50 * time.Millisecond)
+			middle = time.Now()
+			time.Sleep(50 * time.Millisecond)
+		}
+		msg := topicMessage(topic, topic, topic)
+		if err := a.Publish(msg); err != nil {
+			t.Fatalf("publish %s: %v", topic, err)
+		}
+		seqs = append(seqs, msg.Message.Seq)
+	}
+	a.Close()
+	s.Shutdown()
+	s.WaitForShutdown()
+
+	// A new server on the same store and a new broker read the stored history
+	s = runServer(t, dir)
+	b, _ := startBroker(t, s, "b", opts)
+
+	tests := []struct {
+		name     string
+		filter   string
+		sinceSeq uint64
+		since    time.Time
+		want     []string
+	}{
+		{"all", "game/#", 0, time.Time{}, []string{"game/room1", "game", "game/room2"}},
+		{"single level", "game/+", 0, time.Time{}, []string{"game/room1", "game/room2"}},
+		{"since seq", "game/#", seqs[0], time.Time{}, []string{"game", "game/room2"}},
+		{"since time", "#", 0, middle, []string{"game/room2", "chat/lobby"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			messages, err := b.History(test.filter, test.sinceSeq, test.since)
+			if err != nil {
+				t.Fatalf("history: %v", err)
+			}
+			var got []string
+			for i, msg := range messages {
+				got = append(got, msg.Topic)
+				if i > 0 && msg.Seq <= messages[i-1].Seq {
+					t.Fatalf("history not ordered by seq: %v", messages)
+				}
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("history = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,319 @@
+package pkg
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// PresenceConn describes one connection in the cluster
+type PresenceConn struct {
+	NodeID      string    `json:"node_id"`
+	ClientID    string    `json:"client_id"`
+	UserID      string    `json:"user_id"`
+	ConnectedAt time.Time `json:"connected_at"`
+}
+
+// Presence is a registry of connections and topic subscriptions shared by all nodes
+type Presence interface {
+	// Connect registers a connection
+	Connect(conn PresenceConn) error
+	// Disconnect removes a connection together with its subscriptions
+	Disconnect(nodeID, clientID string) error
+	// Join records a subscription of a connection to a topic filter
+	Join(nodeID, clientID, topic string) error
+	// Leave removes a subscription of a connection
+	Leave(nodeID, clientID, topic string) error
+	// ClearNode removes every connection of a node, called when the node shuts down
+	ClearNode(nodeID string) error
+
+	// UserConnections returns the connections of a user on all nodes
+	UserConnections(userID string) ([]PresenceConn, error)
+	// ConnectionCount returns the number of connections on all nodes
+	ConnectionCount() (int, error)
+	// TopicMembers returns the connections on all nodes with a subscription matching
+	// a topic, including wildcard filters such as "game/+" for "game/room1"
+	TopicMembers(topic string) ([]PresenceConn, error)
+}
+
+// presenceKey identifies a connection in the cluster
+type presenceKey struct {
+	nodeID   string
+	clientID string
+}
+
+// MemoryPresence is an in-process presence registry, share one instance between
+// the managers of a MemoryBus to test clustered behavior
+type MemoryPresence struct {
+	mutex  sync.RWMutex
+	conns  map[presenceKey]PresenceConn
+	topics map[string]map[presenceKey]bool
+	joined map[presenceKey]map[string]bool
+}
+
+// NewMemoryPresence creates an in-process presence registry
+func NewMemoryPresence() *MemoryPresence {
+	return &MemoryPresence{
+		conns:  make(map[presenceKey]PresenceConn),
+		topics: make(map[string]map[presenceKey]bool),
+		joined: make(map[presenceKey]map[string]bool),
+	}
+}
+
+// Connect registers a connection
+func (p *MemoryPresence) Connect(conn PresenceConn) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.conns[presenceKey{conn.NodeID, conn.ClientID}] = conn
+	return nil
+}
+
+// Disconnect removes a connection together with its subscriptions
+func (p *MemoryPresence) Disconnect(nodeID, clientID string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.disconnect(presenceKey{nodeID, clientID})
+	return nil
+}
+
+// disconnect removes a connection, the caller must hold the mutex
+func (p *MemoryPresence) disconnect(key presenceKey) {
+	for topic := range p.joined[key] {
+		p.leave(key, topic)
+	}
+	delete(p.conns, key)
+}
+
+// Join records a subscription of a connection to a topic filter
+func (p *MemoryPresence) Join(nodeID, clientID, topic string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	key := presenceKey{nodeID, clientID}
+	if _, ok := p.topics[topic]; !ok {
+		p.topics[topic] = make(map[presenceKey]bool)
+	}
+	if _, ok := p.joined[key]; !ok {
+		p.joined[key] = make(map[string]bool)
+	}
+	p.topics[topic][key] = true
+	p.joined[key][topic] = true
+	return nil
+}
+
+// Leave removes a subscription of a connection
+func (p *MemoryPresence) Leave(nodeID, clientID, topic string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.leave(presenceKey{nodeID, clientID}, topic)
+	return nil
+}
+
+// leave removes a subscription, the caller must hold the mutex
+func (p *MemoryPresence) leave(key presenceKey, topic string) {
+	delete(p.topics[topic], key)
+	if len(p.topics[topic]) == 0 {
+		delete(p.topics, topic)
+	}
+	delete(p.joined[key], topic)
+	if len(p.joined[key]) == 0 {
+		delete(p.joined, key)
+	}
+}
+
+// ClearNode removes every connection of a node
+func (p *MemoryPresence) ClearNode(nodeID string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for key := range p.conns {
+		if key.nodeID == nodeID {
+			p.disconnect(key)
+		}
+	}
+	return nil
+}
+
+// UserConnections returns the connections of a user on all nodes
+func (p *MemoryPresence) UserConnections(userID string) ([]PresenceConn, error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	var conns []PresenceConn
+	for _, conn := range p.conns {
+		if conn.UserID == userID {
+			conns = append(conns, conn)
+		}
+	}
+	sortPresence(conns)
+	return conns, nil
+}
+
+// ConnectionCount returns the number of connections on all nodes
+func (p *MemoryPresence) ConnectionCount() (int, error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return len(p.conns), nil
+}
+
+// TopicMembers returns the connections on all nodes with a subscription matching a topic
+func (p *MemoryPresence) TopicMembers(topic string) ([]PresenceConn, error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	members := make(map[presenceKey]bool)
+	for filter, keys := range p.topics {
+		if TopicMatches(filter, topic) {
+			for key := range keys {
+				members[key] = true
+			}
+		}
+	}
+	var conns []PresenceConn
+	for key := range members {
+		conns = append(conns, p.conns[key])
+	}
+	sortPresence(conns)
+	return conns, nil
+}
+
+// sortPresence orders connections by connect time
+func sortPresence(conns []PresenceConn) {
+	sort.Slice(conns, func(i, j int) bool {
+		if conns[i].ConnectedAt.Equal(conns[j].ConnectedAt) {
+			return conns[i].ClientID < conns[j].ClientID
+		}
+		return conns[i].ConnectedAt.Before(conns[j].ConnectedAt)
+	})
+}
+
+// SetPresence shares this node's connections and subscriptions through a presence registry
+func (m *Manager) SetPresence(presence Presence) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.presence = presence
+	for client := range m.Clients {
+		m.presenceConnect(client)
+		for topic := range client.topics {
+			m.presenceJoin(client, topic)
+		}
+	}
+}
+
+// IsUserOnline reports whether a user has a connection on any node
+func (m *Manager) IsUserOnline(userID string) bool {
+	conns, err := m.GetUserPresence(userID)
+	if err != nil {
+		return m.GetUserConnectionCount(userID) > 0
+	}
+	return len(conns) > 0
+}
+
+// GetUserPresence gets the connections of a user and the nodes they are on,
+// without a presence registry only local connections are returned
+func (m *Manager) GetUserPresence(userID string) ([]PresenceConn, error) {
+	m.mutex.Lock()
+	presence := m.presence
+	if presence == nil {
+		defer m.mutex.Unlock()
+		var conns []PresenceConn
+		for client := range m.users[userID] {
+			conns = append(conns, m.presenceInfo(client))
+		}
+		sortPresence(conns)
+		return conns, nil
+	}
+	m.mutex.Unlock()
+	return presence.UserConnections(userID)
+}
+
+// GetClusterClientCount gets the number of connections on all nodes,
+// without a presence registry it is the same as GetClientCount
+func (m *Manager) GetClusterClientCount() (int, error) {
+	m.mutex.Lock()
+	presence := m.presence
+	m.mutex.Unlock()
+	if presence == nil {
+		return m.GetClientCount(), nil
+	}
+	return presence.ConnectionCount()
+}
+
+// GetTopicMembers gets the connections on all nodes that receive messages published
+// to a topic, without a presence registry only local subscribers are returned
+func (m *Manager) GetTopicMembers(topic string) ([]PresenceConn, error) {
+	m.mutex.Lock()
+	presence := m.presence
+	if presence == nil {
+		defer m.mutex.Unlock()
+		recipients := make(map[*Client]bool)
+		m.topicTree.match(topic, recipients)
+		var conns []PresenceConn
+		for client := range recipients {
+			conns = append(conns, m.presenceInfo(client))
+		}
+		sortPresence(conns)
+		return conns, nil
+	}
+	m.mutex.Unlock()
+	return presence.TopicMembers(topic)
+}
+
+// presenceInfo describes a local client
+func (m *Manager) presenceInfo(client *Client) PresenceConn {
+	return PresenceConn{
+		NodeID:      m.nodeID,
+		ClientID:    client.id,
+		UserID:      client.userID,
+		ConnectedAt: client.connectedAt,
+	}
+}
+
+// presenceConnect registers a local client, the caller must hold the mutex.
+// Like the other presence updates it is applied by the cluster queue.
+func (m *Manager) presenceConnect(client *Client) {
+	if m.presence == nil {
+		return
+	}
+	presence, conn := m.presence, m.presenceInfo(client)
+	m.queueCluster(func() {
+		if err := presence.Connect(conn); err != nil {
+			m.log().Warn("Presence connect failed", client.logArgs("error", err)...)
+		}
+	})
+}
+
+// presenceDisconnect removes a local client, the caller must hold the mutex
+func (m *Manager) presenceDisconnect(client *Client) {
+	if m.presence == nil {
+		return
+	}
+	presence := m.presence
+	m.queueCluster(func() {
+		if err := presence.Disconnect(m.nodeID, client.id); err != nil {
+			m.log().Warn("Presence disconnect failed", client.logArgs("error", err)...)
+		}
+	})
+}
+
+// presenceJoin records a local subscription, the caller must hold the mutex
+func (m *Manager) presenceJoin(client *Client, topic string) {
+	if m.presence == nil {
+		return
+	}
+	presence := m.presence
+	m.queueCluster(func() {
+		if err := presence.Join(m.nodeID, client.id, topic); err != nil {
+			m.log().Warn("Presence join failed", client.logArgs("topic", topic, "error", err)...)
+		}
+	})
+}
+
+// presenceLeave removes a local subscription, the caller must hold the mutex
+func (m *Manager) presenceLeave(client *Client, topic string) {
+	if m.presence == nil {
+		return
+	}
+	presence := m.presence
+	m.queueCluster(func() {
+		if err := presence.Leave(m.nodeID, client.id, topic); err != nil {
+			m.log().Warn("Presence leave failed", client.logArgs("topic", topic, "error", err)...)
+		}
+	})
+}
@@ -0,0 +1,76 @@
+package pkg
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// blockingPresence holds every Join until release is closed
+type blockingPresence struct {
+	*MemoryPresence
+	joining chan struct{}
+	release chan struct{}
+}
+
+func (p *blockingPresence) Join(nodeID, clientID, topic string) error {
+	p.joining <- struct{}{}
+	<-p.release
+	return p.MemoryPresence.Join(nodeID, clientID, topic)
+}
+
+func TestMemoryPresenceTopicMembers(t *testing.T) {
+	p := NewMemoryPresence()
+	for _, id := range []string{"c1", "c2", "c3", "c4"} {
+		p.Connect(PresenceConn{NodeID: "a", ClientID: id})
+	}
+	p.Join("a", "c1", "game/room1")
+	p.Join("a", "c2", "game/+")
+	p.Join("a", "c3", "game/#")
+	p.Join("a", "c3", "game/+") // Counted once
+	p.Join("a", "c4", "chat")
+
+	tests := map[string][]string{
+		"game/room1": {"c1", "c2", "c3"},
+		"game":       {"c3"},
+		"game/a/b":   {"c3"},
+		"chat":       {"c4"},
+		"news":       nil,
+	}
+	for topic, want := range tests {
+		conns, _ := p.TopicMembers(topic)
+		var got []string
+		for _, conn := range conns {
+			got = append(got, conn.ClientID)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("TopicMembers(%q) = %v, want %v", topic, got, want)
+		}
+	}
+}
+
+func TestSlowPresenceDoesNotBlockFanOut(t *testing.T) {
+	m, _, url := startTestManager(t)
+	presence := &blockingPresence{MemoryPresence: NewMemoryPresence(), joining: make(chan struct{}, 2), release: make(chan struct{})}
+	m.SetPresence(presence)
+
+	first := dialTest(t, url)
+	subscribeTest(t, first, "news")
+	<-presence.joining
+
+	// The registry is stuck in Join, subscriptions and publishes still go through
+	second := dialTest(t, url)
+	subscribeTest(t, second, "news")
+	m.PublishTopicMessage(context.Background(), "news", "live")
+	for _, conn := range []*websocket.Conn{first, second} {
+		readFrame(t, conn, func(frame map[string]interface{}) bool { return frame["data"] == "live" })
+	}
+
+	close(presence.release)
+	m.syncCluster()
+	if members, _ := m.GetTopicMembers("news"); len(members) != 2 {
+		t.Fatalf("presence lists %d members after the queue drained, want 2", len(members))
+	}
+}
@@ -0,0 +1,365 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ProtocolVersion is the current version of the command envelope
+const ProtocolVersion = 1
+
+// Client command operations
+const (
+	OpSubscribe   = "subscribe"
+	OpUnsubscribe = "unsubscribe"
+	OpPublish     = "publish"
+	OpPing        = "ping"
+	OpAck         = "ack"
+	OpRefresh     = "refresh"
+	OpCall        = "call"   // Calls a server handler, the server also sends it to call the client
+	OpResult      = "result" // Answers a call, in both directions
+)
+
+// Server reply operations
+const (
+	OpWelcome      = "welcome"
+	OpSubscribed   = "subscribed"
+	OpUnsubscribed = "unsubscribed"
+	OpPublished    = "published"
+	OpPong         = "pong"
+	OpAcked        = "acked"
+	OpRefreshed    = "refreshed"
+	OpReply        = "reply"
+	OpError        = "error"
+)
+
+// Envelope is the versioned command frame exchanged between client and server
+type Envelope struct {
+	V      int     `json:"v,omitempty"`
+	Op     string  `json:"op,omitempty"`
+	Type   string  `json:"type,omitempty"` // Routed message type, used instead of op
+	ID     string  `json:"id,omitempty"`
+	Topic  string  `json:"topic,omitempty"`
+	Data   RawData `json:"data,omitempty"`
+	UserID string  `json:"user_id,omitempty"`
+	Code   int     `json:"code,omitempty"`
+	Error  string  `json:"error,omitempty"`
+
+	// Welcome session details
+	Session string `json:"session,omitempty"` // Token for resuming the session after a reconnect
+	Resumed bool   `json:"resumed,omitempty"` // Whether a previous session was resumed
+
+	// Subscribe options
+	QoS       int     `json:"qos,omitempty"`        // 1 requests at-least-once delivery
+	SinceSeq  *uint64 `json:"since_seq,omitempty"`  // Replay messages with a greater sequence number, topics without wildcards only
+	SinceTime *int64  `json:"since_time,omitempty"` // Replay messages published since this Unix time in milliseconds
+
+	// Publish options
+	ExcludeSelf bool              `json:"exclude_self,omitempty"` // Do not deliver the message back to the publisher
+	Trace       map[string]string `json:"trace,omitempty"`        // Trace context of the publisher, e.g. W3C traceparent
+
+	// Refresh options
+	Token string `json:"token,omitempty"` // Fresh token replacing an expiring one
+}
+
+// RawData is the payload of an envelope. It always holds JSON, codecs encode it as a native
+// value of their format, so MessagePack clients exchange data as MessagePack maps and arrays.
+type RawData []byte
+
+// MarshalJSON returns the data as is
+func (d RawData) MarshalJSON() ([]byte, error) {
+	if len(d) == 0 {
+		return []byte("null"), nil
+	}
+	return d, nil
+}
+
+// UnmarshalJSON stores a copy of the data
+func (d *RawData) UnmarshalJSON(data []byte) error {
+	*d = append((*d)[:0], data...)
+	return nil
+}
+
+// EnableLegacyProtocol accepts the "sub:"/"unsub:" prefixes and plain-text broadcasts
+func (m *Manager) EnableLegacyProtocol() {
+	m.legacyProtocol = true
+}
+
+// DisableLegacyProtocol only accepts envelope commands
+func (m *Manager) DisableLegacyProtocol() {
+	m.legacyProtocol = false
+}
+
+// EnableClientPublish lets clients publish to topics with the publish command
+func (m *Manager) EnableClientPublish() {
+	m.clientPublish = true
+	m.legacyPublish = true
+}
+
+// DisableClientPublish rejects publish commands (default), topics are then only published by
+// the server. Calling it also rejects the plain-text broadcasts of the legacy protocol.
+func (m *Manager) DisableClientPublish() {
+	m.clientPublish = false
+	m.legacyPublish = false
+}
+
+// handleMessage dispatches an incoming frame as an envelope command or a legacy message.
+// Frames of binary codecs are never legacy messages, they are not valid text.
+func (c *Client) handleMessage(message []byte) {
+	legacy := c.manager.legacyProtocol && !c.codec.Binary()
+	var env Envelope
+	err := c.codec.Unmarshal(message, &env)
+	if err != nil && c.codec.Binary() {
+		c.replyError(nil, 1008, fmt.Sprintf("Invalid %s frame: %v", c.codec.Name(), err))
+		return
+	}
+	if err == nil && env.Op != "" {
+		// Legacy clients broadcast their own JSON, which may have an op field of its own
+		if !legacy || env.V != 0 || clientOp(env.Op) {
+			c.handleCommand(&env)
+			return
+		}
+	} else if err == nil && env.Type != "" {
+		if handler := c.manager.handler(env.Type); handler != nil {
+			c.dispatch(&env, handler)
+			return
+		}
+		if !legacy {
+			c.replyError(&env, 1008, fmt.Sprintf("No handler for message type %q", env.Type))
+			return
+		}
+	}
+
+	if !legacy {
+		c.replyError(nil, 1008, "Invalid command envelope")
+		return
+	}
+	c.handleLegacyMessage(message)
+}
+
+// clientOp reports whether op is an operation clients send to the server
+func clientOp(op string) bool {
+	switch op {
+	case OpSubscribe, OpUnsubscribe, OpPublish, OpPing, OpAck, OpRefresh, OpCall, OpResult:
+		return true
+	}
+	return false
+}
+
+// handleCommand executes a single envelope command
+func (c *Client) handleCommand(env *Envelope) {
+	if env.V > ProtocolVersion {
+		c.replyError(env, 1009, fmt.Sprintf("Unsupported protocol version %d", env.V))
+		return
+	}
+
+	switch env.Op {
+	case OpSubscribe, OpUnsubscribe, OpPublish:
+		if env.Topic == "" {
+			c.replyError(env, 1008, "Topic is required")
+			return
+		}
+	}
+
+	switch env.Op {
+	case OpSubscribe:
+		if env.SinceSeq != nil && !validTopicName(env.Topic) {
+			// Sequence numbers are per topic, so one since_seq cannot bound every topic a filter matches
+			c.replyError(env, 1008, "since_seq cannot be used with wildcard filters, use since_time")
+			return
+		}
+		c.manager.debugLog("Subscribing to topic", c.logArgs("topic", env.Topic)...)
+		c.manager.Subscribe <- &Subscription{client: c, topic: env.Topic, cmd: env}
+	case OpUnsubscribe:
+		c.manager.debugLog("Unsubscribing from topic", c.logArgs("topic", env.Topic)...)
+		c.manager.Unsubscribe <- &Subscription{client: c, topic: env.Topic, cmd: env}
+	case OpPublish:
+		if !validTopicName(env.Topic) {
+			c.replyError(env, 1010, fmt.Sprintf("Invalid topic %q", env.Topic))
+			return
+		}
+		if !c.manager.clientPublish {
+			c.replyError(env, 1015, "Client publishing is disabled")
+			return
+		}
+		if err := c.manager.authorize(c, ActionPublish, env.Topic); err != nil {
+			c.replyError(env, 1015, denyMessage(ActionPublish, env.Topic, err))
+			return
+		}
+		c.manager.debugLog("Publishing to topic", c.logArgs("topic", env.Topic)...)
+		message := &TopicResponse{
+			Topic: env.Topic,
+			Data:  envelopeData(json.RawMessage(env.Data)),
+			From:  c.userID,
+		}
+		// Continue the trace of the publishing client, if it sent one
+		span := c.manager.startPublishSpan(c.manager.extractTrace(c.ctx, env.Trace), message, c)
+		c.manager.publishes <- &publication{client: c, message: message, exclude: env.ExcludeSelf}
+		span.End()
+		c.reply(env, OpPublished)
+	case OpPing:
+		c.reply(env, OpPong)
+	case OpAck:
+		if env.ID == "" {
+			c.replyError(env, 1008, "Message ID is required")
+			return
+		}
+		if c.manager.acknowledge(c, env.ID) {
+			c.manager.debugLog("Acknowledged message", c.logArgs("message_id", env.ID)...)
+		}
+		c.reply(env, OpAcked)
+	case OpCall:
+		if env.Type == "" || env.ID == "" {
+			c.replyError(env, 1008, "Method type and call ID are required")
+			return
+		}
+		c.handleCall(env)
+	case OpResult:
+		if env.ID == "" {
+			c.replyError(env, 1008, "Call ID is required")
+			return
+		}
+		c.resolveCall(env)
+	case OpRefresh:
+		if env.Token == "" {
+			c.replyError(env, 1008, "Token is required")
+			return
+		}
+		c.refreshToken(env)
+	default:
+		c.replyError(env, 1008, fmt.Sprintf("Unknown operation %q", env.Op))
+	}
+}
+
+// handleLegacyMessage handles the "sub:"/"unsub:" prefixes, anything else is broadcast
+// unless client publishing was disabled or the authorizer denies it
+func (c *Client) handleLegacyMessage(message []byte) {
+	msgStr := string(message)
+	if strings.HasPrefix(msgStr, "sub:") {
+		topic := msgStr[4:]
+		c.manager.debugLog("Subscribing to topic", c.logArgs("topic", topic)...)
+		c.manager.Subscribe <- &Subscription{client: c, topic: topic}
+	} else if strings.HasPrefix(msgStr, "unsub:") {
+		topic := msgStr[6:]
+		c.manager.debugLog("Unsubscribing from topic", c.logArgs("topic", topic)...)
+		c.manager.Unsubscribe <- &Subscription{client: c, topic: topic}
+	} else {
+		if err := c.authorizeLegacyBroadcast(); err != nil {
+			c.manager.reportError(&ErrorEvent{
+				Client:  c,
+				Message: fmt.Sprintf("Not authorized to broadcast: %v", err),
+				Code:    1015,
+				Time:    time.Now(),
+			})
+			return
+		}
+		// 广播消息给其他客户端
+		c.manager.debugLog("Broadcasting message to other clients", c.logArgs(c.manager.payloadArgs(message)...)...)
+		// 不发送给消息发送者自己
+		c.manager.BroadcastMessage(message, c)
+	}
+}
+
+// authorizeLegacyBroadcast checks that client publishing was not disabled and asks
+// the authorizer about the broadcast
+func (c *Client) authorizeLegacyBroadcast() error {
+	if !c.manager.legacyPublish {
+		return errors.New("client publishing is disabled")
+	}
+	return c.manager.authorize(c, ActionBroadcast, "")
+}
+
+// writeWelcome greets a freshly upgraded connection before its pumps start
+func (c *Client) writeWelcome() error {
+	if c.manager.legacyProtocol && !c.codec.Binary() && c.sessionToken == "" {
+		welcomeMsg := fmt.Sprintf("Hello, %s! Welcome to WebSocket server.", c.userID)
+		return c.conn.WriteMessage(websocket.TextMessage, []byte(welcomeMsg))
+	}
+
+	frame, err := c.codec.Marshal(&Envelope{
+		V:       ProtocolVersion,
+		Op:      OpWelcome,
+		UserID:  c.userID,
+		Session: c.sessionToken,
+		Resumed: c.resumed != nil,
+	})
+	if err != nil {
+		return err
+	}
+	return c.conn.WriteMessage(c.messageType(), frame)
+}
+
+// rejectSubscription reports a refused subscription, replying only to envelope commands
+func (c *Client) rejectSubscription(sub *Subscription, code int, message string) {
+	if sub.cmd != nil {
+		c.replyError(sub.cmd, code, message)
+		return
+	}
+	c.manager.reportError(&ErrorEvent{
+		Client:  c,
+		Message: message,
+		Code:    code,
+		Time:    time.Now(),
+	})
+}
+
+// reply answers a command with the given reply operation
+func (c *Client) reply(cmd *Envelope, op string) {
+	env := &Envelope{Op: op}
+	if cmd != nil {
+		env.ID = cmd.ID
+		env.Topic = cmd.Topic
+	}
+	c.sendEnvelope(env)
+}
+
+// replyError answers a command with an error frame
+func (c *Client) replyError(cmd *Envelope, code int, message string) {
+	env := &Envelope{Op: OpError, Code: code, Error: message}
+	if cmd != nil {
+		env.ID = cmd.ID
+		env.Type = cmd.Type
+		env.Topic = cmd.Topic
+	}
+	c.sendEnvelope(env)
+
+	c.manager.reportError(&ErrorEvent{
+		Client:  c,
+		Message: message,
+		Code:    code,
+		Time:    time.Now(),
+	})
+}
+
+// sendEnvelope queues an envelope frame on the client's send channel
+func (c *Client) sendEnvelope(env *Envelope) {
+	env.V = ProtocolVersion
+	frame, err := c.codec.Marshal(env)
+	if err != nil {
+		c.manager.log().Error("Failed to encode frame", c.logArgs("op", env.Op, "error", err)...)
+		return
+	}
+	c.enqueue(frame)
+}
+
+// messageType returns the WebSocket frame type used by the client's codec
+func (c *Client) messageType() int {
+	if c.codec.Binary() {
+		return websocket.BinaryMessage
+	}
+	return websocket.TextMessage
+}
+
+// envelopeData converts envelope data into a topic payload, JSON strings are unquoted
+func envelopeData(raw json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+	return string(raw)
+}
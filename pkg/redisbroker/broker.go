@@ -0,0 +1,200 @@
+// Package redisbroker relays tank-websocket cluster traffic through Redis pub/sub and
+// shares presence between the nodes in Redis hashes.
+package redisbroker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	tkws "github.com/fanqie/tank-websocket-go-server/pkg"
+	"github.com/redis/go-redis/v9"
+)
+
+// Options configures the Redis broker
+type Options struct {
+	// Prefix namespaces the Redis channels, defaults to "tkws"
+	Prefix string
+	// HealthCheckInterval is how often the subscription connection is pinged,
+	// a failed check reconnects and resubscribes. Defaults to 3 seconds.
+	HealthCheckInterval time.Duration
+}
+
+// Broker implements tkws.Broker on top of Redis pub/sub.
+// Broadcasts and direct sends share fixed channels, topics map to one channel each
+// and are only subscribed while the node has local subscribers.
+type Broker struct {
+	client redis.UniversalClient
+	opts   Options
+
+	mutex   sync.Mutex
+	pubsub  *redis.PubSub
+	filters map[string]bool
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// New creates a Redis broker using an existing client, which can point at a
+// redis-server, a cluster or miniredis in tests
+func New(client redis.UniversalClient, opts Options) *Broker {
+	if opts.Prefix == "" {
+		opts.Prefix = "tkws"
+	}
+	if opts.HealthCheckInterval <= 0 {
+		opts.HealthCheckInterval = 3 * time.Second
+	}
+	return &Broker{
+		client:  client,
+		opts:    opts,
+		filters: make(map[string]bool),
+	}
+}
+
+// Start subscribes to the broadcast, direct and close channels and starts receiving
+func (b *Broker) Start(nodeID string, handler func(msg *tkws.BrokerMessage)) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	pubsub := b.client.Subscribe(ctx,
+		b.channel(tkws.BrokerBroadcast), b.channel(tkws.BrokerUser), b.channel(tkws.BrokerClose))
+	// Wait for the subscription so that messages published right after Start are not lost
+	if _, err := pubsub.Receive(ctx); err != nil {
+		cancel()
+		pubsub.Close()
+		return fmt.Errorf("redis subscribe: %w", err)
+	}
+
+	b.mutex.Lock()
+	b.pubsub = pubsub
+	b.cancel = cancel
+	b.done = make(chan struct{})
+	b.mutex.Unlock()
+
+	// The channel reconnects and resubscribes after connection errors
+	messages := pubsub.Channel(redis.WithChannelHealthCheckInterval(b.opts.HealthCheckInterval))
+	go b.receive(messages, handler)
+	return nil
+}
+
+// receive decodes messages until the subscription is closed
+func (b *Broker) receive(messages <-chan *redis.Message, handler func(msg *tkws.BrokerMessage)) {
+	defer close(b.done)
+	for message := range messages {
+		var msg tkws.BrokerMessage
+		if err := json.Unmarshal([]byte(message.Payload), &msg); err != nil {
+			continue
+		}
+		if msg.Kind == tkws.BrokerTopic && !b.wants(msg.Topic) {
+			continue
+		}
+		handler(&msg)
+	}
+}
+
+// wants reports whether a topic matches a subscribed filter, patterns are coarser than filters
+func (b *Broker) wants(topic string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for filter := range b.filters {
+		if tkws.TopicMatches(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// Publish sends a message to every node
+func (b *Broker) Publish(msg *tkws.BrokerMessage) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	channel := b.channel(msg.Kind)
+	if msg.Kind == tkws.BrokerTopic {
+		channel = b.topicChannel(msg.Topic)
+	}
+	return b.client.Publish(context.Background(), channel, payload).Err()
+}
+
+// Subscribe listens on the channel of a topic, or a pattern for wildcard filters
+func (b *Broker) Subscribe(filter string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.pubsub == nil {
+		return fmt.Errorf("redis broker not started")
+	}
+
+	b.filters[filter] = true
+	if pattern, ok := b.topicPattern(filter); ok {
+		return b.pubsub.PSubscribe(context.Background(), pattern)
+	}
+	return b.pubsub.Subscribe(context.Background(), b.topicChannel(filter))
+}
+
+// Unsubscribe stops listening for a topic filter
+func (b *Broker) Unsubscribe(filter string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.pubsub == nil {
+		return nil
+	}
+
+	delete(b.filters, filter)
+	if pattern, ok := b.topicPattern(filter); ok {
+		return b.pubsub.PUnsubscribe(context.Background(), pattern)
+	}
+	return b.pubsub.Unsubscribe(context.Background(), b.topicChannel(filter))
+}
+
+// Close closes the subscription, the Redis client is left open for its owner
+func (b *Broker) Close() error {
+	b.mutex.Lock()
+	pubsub, cancel, done := b.pubsub, b.cancel, b.done
+	b.pubsub = nil
+	b.mutex.Unlock()
+	if pubsub == nil {
+		return nil
+	}
+
+	cancel()
+	err := pubsub.Close()
+	<-done
+	return err
+}
+
+func (b *Broker) channel(kind string) string {
+	return b.opts.Prefix + ":" + kind
+}
+
+func (b *Broker) topicChannel(topic string) string {
+	return b.opts.Prefix + ":topic:" + topic
+}
+
+// topicPattern converts a wildcard filter into a glob pattern that matches a superset
+// of its topics, "game/+/score" becomes "game/*/score" and "game/#" becomes "game*"
+func (b *Broker) topicPattern(filter string) (string, bool) {
+	if !strings.ContainsAny(filter, "+#") {
+		return "", false
+	}
+
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		switch level {
+		case "+":
+			levels[i] = "*"
+		case "#":
+			// "#" also matches the parent level, so drop the separator before it
+			return globEscape(b.topicChannel("")) + strings.Join(levels[:i], "/") + "*", true
+		default:
+			levels[i] = globEscape(level)
+		}
+	}
+	return globEscape(b.topicChannel("")) + strings.Join(levels, "/"), true
+}
+
+// globEscape escapes the Redis glob metacharacters
+func globEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`).Replace(s)
+}
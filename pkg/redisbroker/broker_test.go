@@ -0,0 +1,182 @@
+package redisbroker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	tkws "github.com/fanqie/tank-websocket-go-server/pkg"
+	"github.com/redis/go-redis/v9"
+)
+
+// startBroker connects a broker to mr, received messages are sent on the returned channel
+func startBroker(t *testing.T, mr *miniredis.Miniredis, nodeID string) (*Broker, chan *tkws.BrokerMessage) {
+	t.Helper()
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	received := make(chan *tkws.BrokerMessage, 16)
+	b := New(client, Options{})
+	if err := b.Start(nodeID, func(msg *tkws.BrokerMessage) { received <- msg }); err != nil {
+		t.Fatalf("start broker: %v", err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b, received
+}
+
+// waitSubscribed waits until the server registered the channel and pattern subscriptions
+func waitSubscribed(t *testing.T, mr *miniredis.Miniredis, channels, patterns int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if len(mr.PubSubChannels("tkws:topic:*")) == channels && mr.PubSubNumPat() == patterns {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("subscriptions not registered, want %d channels and %d patterns", channels, patterns)
+}
+
+func receive(t *testing.T, received chan *tkws.BrokerMessage) *tkws.BrokerMessage {
+	t.Helper()
+	select {
+	case msg := <-received:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+		return nil
+	}
+}
+
+func expectNone(t *testing.T, received chan *tkws.BrokerMessage) {
+	t.Helper()
+	select {
+	case msg := <-received:
+		t.Fatalf("unexpected message %+v", msg)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func topicMessage(nodeID, topic string) *tkws.BrokerMessage {
+	return &tkws.BrokerMessage{
+		ID:      topic,
+		Kind:    tkws.BrokerTopic,
+		NodeID:  nodeID,
+		Topic:   topic,
+		Message: &tkws.TopicResponse{Topic: topic, Data: topic},
+	}
+}
+
+func TestTwoNodes(t *testing.T) {
+	mr := miniredis.RunT(t)
+	a, fromB := startBroker(t, mr, "a")
+	b, fromA := startBroker(t, mr, "b")
+
+	for _, filter := range []string{"news", "game/+/score", "chat/#"} {
+		if err := b.Subscribe(filter); err != nil {
+			t.Fatalf("subscribe %s: %v", filter, err)
+		}
+	}
+	waitSubscribed(t, mr, 1, 2)
+
+	// Topics outside the filters are dropped even when the glob pattern matches them
+	for _, topic := range []string{"news", "game/r1/score", "game/r1/chat", "chat", "chat/lobby/en", "chatter", "other"} {
+		if err := a.Publish(topicMessage("a", topic)); err != nil {
+			t.Fatalf("publish %s: %v", topic, err)
+		}
+	}
+	for _, topic := range []string{"news", "game/r1/score", "chat", "chat/lobby/en"} {
+		msg := receive(t, fromA)
+		if msg.Kind != tkws.BrokerTopic || msg.Topic != topic || msg.Message.Data != topic || msg.NodeID != "a" {
+			t.Fatalf("got %+v, want topic %s", msg, topic)
+		}
+	}
+	expectNone(t, fromA)
+
+	b.Publish(&tkws.BrokerMessage{ID: "1", Kind: tkws.BrokerBroadcast, NodeID: "b", Data: []byte("hello")})
+	b.Publish(&tkws.BrokerMessage{ID: "2", Kind: tkws.BrokerUser, NodeID: "b", UserID: "u1", Data: []byte("direct")})
+	b.Publish(&tkws.BrokerMessage{ID: "3", Kind: tkws.BrokerClose, NodeID: "b", UserID: "u1"})
+	if msg := receive(t, fromB); msg.Kind != tkws.BrokerBroadcast || string(msg.Data) != "hello" {
+		t.Fatalf("got %+v, want broadcast", msg)
+	}
+	if msg := receive(t, fromB); msg.Kind != tkws.BrokerUser || msg.UserID != "u1" || string(msg.Data) != "direct" {
+		t.Fatalf("got %+v, want user message", msg)
+	}
+	if msg := receive(t, fromB); msg.Kind != tkws.BrokerClose || msg.UserID != "u1" {
+		t.Fatalf("got %+v, want close", msg)
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	mr := miniredis.RunT(t)
+	a, _ := startBroker(t, mr, "a")
+	b, received := startBroker(t, mr, "b")
+
+	b.Subscribe("news")
+	b.Subscribe("game/+")
+	waitSubscribed(t, mr, 1, 1)
+	a.Publish(topicMessage("a", "news"))
+	a.Publish(topicMessage("a", "game/r1"))
+	receive(t, received)
+	receive(t, received)
+
+	for _, filter := range []string{"news", "game/+"} {
+		if err := b.Unsubscribe(filter); err != nil {
+			t.Fatalf("unsubscribe %s: %v", filter, err)
+		}
+	}
+	waitSubscribed(t, mr, 0, 0)
+	a.Publish(topicMessage("a", "news"))
+	a.Publish(topicMessage("a", "game/r1"))
+	expectNone(t, received)
+}
+
+func TestTopicPattern(t *testing.T) {
+	b := New(nil, Options{})
+	tests := []struct {
+		filter  string
+		pattern string
+	}{
+		{"game/+", "tkws:topic:game/*"},
+		{"+/score", "tkws:topic:*/score"},
+		{"game/+/score", "tkws:topic:game/*/score"},
+		{"game/#", "tkws:topic:game*"},
+		{"game/+/#", "tkws:topic:game/**"},
+		{"#", "tkws:topic:*"},
+		{`a*b?/[x]/+`, `tkws:topic:a\*b\?/\[x\]/*`},
+		{`back\slash/#`, `tkws:topic:back\\slash*`},
+	}
+	for _, test := range tests {
+		pattern, ok := b.topicPattern(test.filter)
+		if !ok || pattern != test.pattern {
+			t.Errorf("topicPattern(%q) = %q, %v, want %q", test.filter, pattern, ok, test.pattern)
+		}
+	}
+	if pattern, ok := b.topicPattern("game/room1"); ok {
+		t.Errorf("topicPattern(game/room1) = %q, want no pattern", pattern)
+	}
+}
+
+func TestGlobEscape(t *testing.T) {
+	got := globEscape(`a*b?c[d]e\f`)
+	if want := `a\*b\?c\[d\]e\\f`; got != want {
+		t.Fatalf("globEscape = %q, want %q", got, want)
+	}
+
+	// An escaped pattern only matches the literal topic
+	mr := miniredis.RunT(t)
+	a, _ := startBroker(t, mr, "a")
+	b, received := startBroker(t, mr, "b")
+	b.Subscribe("odd*/+")
+	waitSubscribed(t, mr, 0, 1)
+	b.mutex.Lock()
+	b.filters = map[string]bool{"#": true} // Let every received topic through
+	b.mutex.Unlock()
+
+	a.Publish(topicMessage("a", "oddity/x"))
+	a.Publish(topicMessage("a", "odd*/x"))
+	if msg := receive(t, received); msg.Topic != "odd*/x" {
+		t.Fatalf("got topic %s, want odd*/x", msg.Topic)
+	}
+	expectNone(t, received)
+}
@@ -0,0 +1,282 @@
+package redisbroker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	tkws "github.com/fanqie/tank-websocket-go-server/pkg"
+	"github.com/redis/go-redis/v9"
+)
+
+// PresenceOptions configures the Redis presence registry
+type PresenceOptions struct {
+	// Prefix namespaces the Redis keys, defaults to "tkws"
+	Prefix string
+	// TTL is how long the connections of a node outlive its last heartbeat, so a
+	// crashed node's users go offline. Heartbeats run every TTL/3. Defaults to 30 seconds.
+	TTL time.Duration
+}
+
+// Presence implements tkws.Presence with one Redis hash per node, mapping client
+// IDs to the connection and its subscriptions. Every node only writes its own hash
+// and refreshes its expiry with a heartbeat, queries read the hashes of all nodes.
+type Presence struct {
+	client redis.UniversalClient
+	opts   PresenceOptions
+
+	mutex sync.Mutex
+	nodes map[string]map[string]*presenceEntry // Local connections by node and client ID
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// presenceEntry is the value of a connection in its node's hash
+type presenceEntry struct {
+	tkws.PresenceConn
+	Topics []string `json:"topics,omitempty"`
+}
+
+// removeNodeScript drops a node from the node set once its hash has expired
+var removeNodeScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[2]) == 0 then
+	return redis.call("SREM", KEYS[1], ARGV[1])
+end
+return 0
+`)
+
+// NewPresence creates a Redis presence registry and starts its heartbeat,
+// Close stops the heartbeat
+func NewPresence(client redis.UniversalClient, opts PresenceOptions) *Presence {
+	if opts.Prefix == "" {
+		opts.Prefix = "tkws"
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = 30 * time.Second
+	}
+	p := &Presence{
+		client: client,
+		opts:   opts,
+		nodes:  make(map[string]map[string]*presenceEntry),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go p.heartbeat()
+	return p
+}
+
+// Connect registers a connection
+func (p *Presence) Connect(conn tkws.PresenceConn) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if _, ok := p.nodes[conn.NodeID]; !ok {
+		p.nodes[conn.NodeID] = make(map[string]*presenceEntry)
+	}
+	entry := &presenceEntry{PresenceConn: conn}
+	p.nodes[conn.NodeID][conn.ClientID] = entry
+	return p.write(conn.NodeID, entry)
+}
+
+// Disconnect removes a connection together with its subscriptions
+func (p *Presence) Disconnect(nodeID, clientID string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.nodes[nodeID], clientID)
+	return p.client.HDel(context.Background(), p.nodeKey(nodeID), clientID).Err()
+}
+
+// Join records a subscription of a connection to a topic filter
+func (p *Presence) Join(nodeID, clientID, topic string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	entry, ok := p.nodes[nodeID][clientID]
+	if !ok {
+		return fmt.Errorf("redis presence: unknown connection %s", clientID)
+	}
+	for _, joined := range entry.Topics {
+		if joined == topic {
+			return nil
+		}
+	}
+	entry.Topics = append(entry.Topics, topic)
+	return p.write(nodeID, entry)
+}
+
+// Leave removes a subscription of a connection
+func (p *Presence) Leave(nodeID, clientID, topic string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	entry, ok := p.nodes[nodeID][clientID]
+	if !ok {
+		return nil
+	}
+	for i, joined := range entry.Topics {
+		if joined == topic {
+			entry.Topics = append(entry.Topics[:i], entry.Topics[i+1:]...)
+			return p.write(nodeID, entry)
+		}
+	}
+	return nil
+}
+
+// ClearNode removes every connection of a node
+func (p *Presence) ClearNode(nodeID string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.nodes, nodeID)
+	_, err := p.client.TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		pipe.Del(context.Background(), p.nodeKey(nodeID))
+		pipe.SRem(context.Background(), p.nodesKey(), nodeID)
+		return nil
+	})
+	return err
+}
+
+// UserConnections returns the connections of a user on all nodes
+func (p *Presence) UserConnections(userID string) ([]tkws.PresenceConn, error) {
+	return p.query(func(entry *presenceEntry) bool {
+		return entry.UserID == userID
+	})
+}
+
+// ConnectionCount returns the number of connections on all nodes
+func (p *Presence) ConnectionCount() (int, error) {
+	conns, err := p.query(func(entry *presenceEntry) bool { return true })
+	return len(conns), err
+}
+
+// TopicMembers returns the connections on all nodes with a subscription matching a topic
+func (p *Presence) TopicMembers(topic string) ([]tkws.PresenceConn, error) {
+	return p.query(func(entry *presenceEntry) bool {
+		for _, filter := range entry.Topics {
+			if tkws.TopicMatches(filter, topic) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// Close stops the heartbeat, the connections expire after the TTL unless ClearNode
+// removed them. The Redis client is left open for its owner.
+func (p *Presence) Close() error {
+	p.mutex.Lock()
+	select {
+	case <-p.stop:
+	default:
+		close(p.stop)
+	}
+	p.mutex.Unlock()
+	<-p.done
+	return nil
+}
+
+// write stores a connection in its node's hash and renews the hash expiry,
+// the caller must hold the mutex
+func (p *Presence) write(nodeID string, entry *presenceEntry) error {
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	_, err = p.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, p.nodeKey(nodeID), entry.ClientID, value)
+		pipe.PExpire(ctx, p.nodeKey(nodeID), p.opts.TTL)
+		pipe.SAdd(ctx, p.nodesKey(), nodeID)
+		return nil
+	})
+	return err
+}
+
+// heartbeat renews the expiry of the local nodes' hashes until Close
+func (p *Presence) heartbeat() {
+	defer close(p.done)
+	ticker := time.NewTicker(p.opts.TTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.refresh()
+		}
+	}
+}
+
+// refresh renews the hash expiry of every node with local connections, a hash
+// lost to a Redis restart or a missed heartbeat is written again. Failures are
+// retried on the next heartbeat.
+func (p *Presence) refresh() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	ctx := context.Background()
+	for nodeID, entries := range p.nodes {
+		if len(entries) == 0 {
+			continue
+		}
+		renewed, err := p.client.PExpire(ctx, p.nodeKey(nodeID), p.opts.TTL).Result()
+		if err != nil || renewed {
+			p.client.SAdd(ctx, p.nodesKey(), nodeID)
+			continue
+		}
+		for _, entry := range entries {
+			p.write(nodeID, entry)
+		}
+	}
+}
+
+// query returns the connections on all nodes that match, nodes whose hash
+// expired are removed from the node set
+func (p *Presence) query(match func(entry *presenceEntry) bool) ([]tkws.PresenceConn, error) {
+	ctx := context.Background()
+	nodeIDs, err := p.client.SMembers(ctx, p.nodesKey()).Result()
+	if err != nil {
+		return nil, fmt.Errorf("redis presence: %w", err)
+	}
+
+	values := make([]*redis.StringSliceCmd, len(nodeIDs))
+	_, err = p.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, nodeID := range nodeIDs {
+			values[i] = pipe.HVals(ctx, p.nodeKey(nodeID))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("redis presence: %w", err)
+	}
+
+	var conns []tkws.PresenceConn
+	for i, nodeID := range nodeIDs {
+		if len(values[i].Val()) == 0 {
+			removeNodeScript.Run(ctx, p.client, []string{p.nodesKey(), p.nodeKey(nodeID)}, nodeID)
+			continue
+		}
+		for _, value := range values[i].Val() {
+			var entry presenceEntry
+			if json.Unmarshal([]byte(value), &entry) == nil && match(&entry) {
+				conns = append(conns, entry.PresenceConn)
+			}
+		}
+	}
+	sort.Slice(conns, func(i, j int) bool {
+		if conns[i].ConnectedAt.Equal(conns[j].ConnectedAt) {
+			return conns[i].ClientID < conns[j].ClientID
+		}
+		return conns[i].ConnectedAt.Before(conns[j].ConnectedAt)
+	})
+	return conns, nil
+}
+
+// The keys share a hash tag, so transactions and scripts using several of them
+// stay in one slot of a Redis Cluster
+
+func (p *Presence) nodesKey() string {
+	return p.opts.Prefix + ":{presence}:nodes"
+}
+
+func (p *Presence) nodeKey(nodeID string) string {
+	return p.opts.Prefix + ":{presence}:node:" + nodeID
+}
@@ -0,0 +1,109 @@
+package redisbroker
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	tkws "github.com/fanqie/tank-websocket-go-server/pkg"
+	"github.com/redis/go-redis/v9"
+)
+
+func newPresence(t *testing.T, mr *miniredis.Miniredis, ttl time.Duration) *Presence {
+	t.Helper()
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	p := NewPresence(client, PresenceOptions{TTL: ttl})
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+// clientIDs lists the client IDs of a query result, an error is returned in their place
+func clientIDs(conns []tkws.PresenceConn, err error) []string {
+	if err != nil {
+		return []string{err.Error()}
+	}
+	var ids []string
+	for _, conn := range conns {
+		ids = append(ids, conn.ClientID)
+	}
+	return ids
+}
+
+func TestPresence(t *testing.T) {
+	mr := miniredis.RunT(t)
+	a := newPresence(t, mr, time.Hour)
+	b := newPresence(t, mr, time.Hour)
+
+	now := time.Now()
+	a.Connect(tkws.PresenceConn{NodeID: "a", ClientID: "c1", UserID: "u1", ConnectedAt: now})
+	a.Connect(tkws.PresenceConn{NodeID: "a", ClientID: "c2", UserID: "u2", ConnectedAt: now.Add(time.Second)})
+	b.Connect(tkws.PresenceConn{NodeID: "b", ClientID: "c3", UserID: "u1", ConnectedAt: now.Add(2 * time.Second)})
+	a.Join("a", "c1", "game/room1")
+	a.Join("a", "c2", "game/+")
+	b.Join("b", "c3", "game/#")
+	b.Join("b", "c3", "chat")
+
+	if got := clientIDs(b.UserConnections("u1")); !reflect.DeepEqual(got, []string{"c1", "c3"}) {
+		t.Fatalf("user connections %v, want [c1 c3]", got)
+	}
+	if n, err := b.ConnectionCount(); err != nil || n != 3 {
+		t.Fatalf("connection count %d, %v, want 3", n, err)
+	}
+	if got := clientIDs(a.TopicMembers("game/room1")); !reflect.DeepEqual(got, []string{"c1", "c2", "c3"}) {
+		t.Fatalf("members of game/room1 %v, want [c1 c2 c3]", got)
+	}
+	if got := clientIDs(a.TopicMembers("game")); !reflect.DeepEqual(got, []string{"c3"}) {
+		t.Fatalf("members of game %v, want [c3]", got)
+	}
+
+	b.Leave("b", "c3", "game/#")
+	a.Disconnect("a", "c1")
+	if got := clientIDs(a.TopicMembers("game/room1")); !reflect.DeepEqual(got, []string{"c2"}) {
+		t.Fatalf("members of game/room1 %v, want [c2]", got)
+	}
+
+	b.ClearNode("b")
+	if got := clientIDs(a.UserConnections("u1")); got != nil {
+		t.Fatalf("user connections %v after clearing node b, want none", got)
+	}
+}
+
+func TestPresenceNodeExpiry(t *testing.T) {
+	mr := miniredis.RunT(t)
+	crashed := newPresence(t, mr, 300*time.Millisecond)
+	alive := newPresence(t, mr, time.Hour)
+	crashed.Connect(tkws.PresenceConn{NodeID: "a", ClientID: "c1", UserID: "u1"})
+	alive.Connect(tkws.PresenceConn{NodeID: "b", ClientID: "c2", UserID: "u1"})
+
+	// A node that stops heartbeating goes offline after the TTL
+	crashed.Close()
+	mr.FastForward(time.Second)
+	if got := clientIDs(alive.UserConnections("u1")); !reflect.DeepEqual(got, []string{"c2"}) {
+		t.Fatalf("user connections %v, want [c2]", got)
+	}
+	if nodes, _ := mr.Members(alive.nodesKey()); !reflect.DeepEqual(nodes, []string{"b"}) {
+		t.Fatalf("nodes %v, want [b]", nodes)
+	}
+}
+
+func TestPresenceHeartbeatRestoresHash(t *testing.T) {
+	mr := miniredis.RunT(t)
+	p := newPresence(t, mr, 150*time.Millisecond)
+	p.Connect(tkws.PresenceConn{NodeID: "a", ClientID: "c1", UserID: "u1"})
+	p.Join("a", "c1", "news")
+
+	// Lost like after a Redis restart, the next heartbeat writes it again
+	mr.Del(p.nodeKey("a"))
+	deadline := time.Now().Add(5 * time.Second)
+	for !mr.Exists(p.nodeKey("a")) {
+		if time.Now().After(deadline) {
+			t.Fatal("heartbeat did not restore the node hash")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := clientIDs(p.TopicMembers("news")); !reflect.DeepEqual(got, []string{"c1"}) {
+		t.Fatalf("members of news %v, want [c1]", got)
+	}
+}
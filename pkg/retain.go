@@ -0,0 +1,77 @@
+package pkg
+
+import (
+	"context"
+	"sort"
+)
+
+// EnableRetain retains the last message published to topics matching the filter
+func (m *Manager) EnableRetain(filter string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.retainFilters[filter] = true
+}
+
+// DisableRetain stops retaining messages for the filter, existing values are kept
+func (m *Manager) DisableRetain(filter string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.retainFilters, filter)
+}
+
+// SetRetained sets the retained value of a topic without publishing it
+func (m *Manager) SetRetained(topic string, data string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.retained[topic] = &TopicResponse{Topic: topic, Data: data, Retained: true}
+}
+
+// ClearRetained removes the retained value of a topic
+func (m *Manager) ClearRetained(topic string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.retained, topic)
+}
+
+// GetRetained gets the retained value of a topic
+func (m *Manager) GetRetained(topic string) (TopicResponse, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if message, ok := m.retained[topic]; ok {
+		return *message, true
+	}
+	return TopicResponse{}, false
+}
+
+// GetRetainedTopics gets all topics that have a retained value
+func (m *Manager) GetRetainedTopics() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	topics := make([]string, 0, len(m.retained))
+	for topic := range m.retained {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// retainMessage stores a published message if its topic is retained, the caller must hold the mutex
+func (m *Manager) retainMessage(message *TopicResponse) {
+	for filter := range m.retainFilters {
+		if TopicMatches(filter, message.Topic) {
+			retained := *message
+			retained.Retained = true
+			m.retained[message.Topic] = &retained
+			return
+		}
+	}
+}
+
+// sendRetained delivers the retained values matching a new subscription, the caller must hold the mutex
+func (m *Manager) sendRetained(client *Client, filter string) {
+	for topic, message := range m.retained {
+		if TopicMatches(filter, topic) {
+			m.sendTopicFrame(context.Background(), client, make(map[string][]byte), message)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// HandlerFunc handles a typed message from a client, a returned error is sent
+// back as an error frame
+type HandlerFunc func(ctx *HandlerContext) error
+
+// HandlerContext carries a routed message together with its sender
+type HandlerContext struct {
+	Client    *Client
+	Principal *Principal
+	Type      string
+	ID        string          // Correlation ID chosen by the client, echoed in replies
+	Data      json.RawMessage // JSON payload whatever the client's codec, use Bind to decode it
+	env       *Envelope
+	ctx       context.Context
+	replied   bool
+}
+
+// Context returns a context that is cancelled when the client disconnects or the
+// handler timeout passes. Cancelling it does not stop the handler, which must watch it.
+func (ctx *HandlerContext) Context() context.Context {
+	return ctx.ctx
+}
+
+// Bind decodes the JSON payload into v
+func (ctx *HandlerContext) Bind(v interface{}) error {
+	if len(ctx.Data) == 0 {
+		return fmt.Errorf("message %q has no data", ctx.Type)
+	}
+	return json.Unmarshal(ctx.Data, v)
+}
+
+// Reply sends data back to the client with the message's type and ID,
+// as a "result" frame for calls and a "reply" frame otherwise. The data is
+// encoded with the client's codec, e.g. as a MessagePack map.
+func (ctx *HandlerContext) Reply(data interface{}) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	op := OpReply
+	if ctx.env.Op == OpCall {
+		op = OpResult
+	}
+	ctx.replied = true
+	ctx.Client.sendEnvelope(&Envelope{Op: op, Type: ctx.Type, ID: ctx.ID, Data: raw})
+	return nil
+}
+
+// Error sends an error frame for the message
+func (ctx *HandlerContext) Error(code int, message string) {
+	ctx.replied = true
+	ctx.Client.replyError(ctx.env, code, message)
+}
+
+// Handle registers the handler for messages of a type, nil removes it.
+// Every message is handled on its own goroutine, so the handlers of one client can run
+// concurrently, up to the limit set by SetHandlerLimit, and a handler may call back
+// into the same client with Call.
+func (m *Manager) Handle(messageType string, handler HandlerFunc) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if handler == nil {
+		delete(m.handlers, messageType)
+		return
+	}
+	m.handlers[messageType] = handler
+}
+
+// handler returns the handler registered for a type
+func (m *Manager) handler(messageType string) HandlerFunc {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.handlers[messageType]
+}
+
+// dispatch runs the handler of a typed message or call on its own goroutine, so the
+// read goroutine keeps reading, e.g. the result of a Call the handler is waiting for.
+// Waiting for a free slot would block that read, so a message over the limit is refused.
+func (c *Client) dispatch(env *Envelope, handler HandlerFunc) {
+	if c.handlerSlots != nil {
+		select {
+		case c.handlerSlots <- struct{}{}:
+		default:
+			c.replyError(env, 1018, fmt.Sprintf("Too many concurrent handlers, limit is %d", cap(c.handlerSlots)))
+			return
+		}
+	}
+	go func() {
+		if c.handlerSlots != nil {
+			defer func() { <-c.handlerSlots }()
+		}
+		c.runHandler(env, handler)
+	}()
+}
+
+// runHandler runs a handler and answers for it. A call always gets an answer, an empty
+// result if the handler did not reply, or error 1017 if it also ran past its deadline.
+func (c *Client) runHandler(env *Envelope, handler HandlerFunc) {
+	handlerCtx, cancel := c.handlerContext()
+	defer cancel()
+	ctx := &HandlerContext{
+		Client:    c,
+		Principal: c.Principal(),
+		Type:      env.Type,
+		ID:        env.ID,
+		Data:      json.RawMessage(env.Data),
+		env:       env,
+		ctx:       handlerCtx,
+	}
+
+	err := handler(ctx)
+	switch {
+	case ctx.replied && err == nil:
+		// Answered by the handler, even if it returned after the deadline
+	case !ctx.replied && errors.Is(handlerCtx.Err(), context.DeadlineExceeded):
+		c.replyError(env, 1017, fmt.Sprintf("Handler for %q timed out", env.Type))
+	case err != nil:
+		c.replyError(env, 1016, err.Error())
+	case env.Op == OpCall:
+		c.sendEnvelope(&Envelope{Op: OpResult, Type: env.Type, ID: env.ID})
+	}
+}
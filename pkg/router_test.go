@@ -0,0 +1,102 @@
+package pkg
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestHandlerCallsBackIntoClient(t *testing.T) {
+	m, _, url := startTestManager(t)
+	m.SetCallTimeout(2 * time.Second)
+	m.Handle("confirm", func(ctx *HandlerContext) error {
+		answer, err := ctx.Client.Call(ctx.Context(), "ask", "sure?")
+		if err != nil {
+			return err
+		}
+		return ctx.Reply(answer)
+	})
+	conn := dialTest(t, url)
+
+	conn.WriteJSON(map[string]interface{}{"op": OpCall, "type": "confirm", "id": "1"})
+	call := readFrame(t, conn, func(frame map[string]interface{}) bool { return frame["op"] == OpCall })
+	if call["type"] != "ask" {
+		t.Fatalf("got call %v, want ask", call)
+	}
+	conn.WriteJSON(map[string]interface{}{"op": OpResult, "id": call["id"], "data": true})
+
+	result := readFrame(t, conn, func(frame map[string]interface{}) bool { return frame["id"] == "1" })
+	if result["op"] != OpResult || result["data"] != true {
+		t.Fatalf("got %v, want the result true", result)
+	}
+}
+
+func TestHandlerRepliedBeforeTimeout(t *testing.T) {
+	m, _, url := startTestManager(t)
+	m.SetHandlerTimeout(50 * time.Millisecond)
+	m.Handle("slow", func(ctx *HandlerContext) error {
+		ctx.Reply("done")
+		<-ctx.Context().Done()
+		time.Sleep(50 * time.Millisecond)
+		return nil
+	})
+	conn := dialTest(t, url)
+
+	conn.WriteJSON(map[string]interface{}{"op": OpCall, "type": "slow", "id": "1"})
+	result := readFrame(t, conn, func(frame map[string]interface{}) bool { return frame["id"] == "1" })
+	if result["op"] != OpResult || result["data"] != "done" {
+		t.Fatalf("got %v, want the result", result)
+	}
+
+	// No timeout error follows the result
+	conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		var frame map[string]interface{}
+		if json.Unmarshal(message, &frame) == nil && frame["id"] == "1" {
+			t.Fatalf("got %v after the result", frame)
+		}
+	}
+}
+
+func TestHandlerLimit(t *testing.T) {
+	m, _, url := startTestManager(t)
+	m.SetHandlerLimit(1)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	m.Handle("wait", func(ctx *HandlerContext) error {
+		started <- struct{}{}
+		<-release
+		return ctx.Reply("done")
+	})
+	conn := dialTest(t, url)
+
+	conn.WriteJSON(map[string]interface{}{"op": OpCall, "type": "wait", "id": "1"})
+	<-started
+	conn.WriteJSON(map[string]interface{}{"op": OpCall, "type": "wait", "id": "2"})
+	refused := readFrame(t, conn, func(frame map[string]interface{}) bool { return frame["id"] == "2" })
+	if refused["op"] != OpError || refused["code"] != float64(1018) {
+		t.Fatalf("got %v, want error 1018", refused)
+	}
+
+	close(release)
+	readFrame(t, conn, func(frame map[string]interface{}) bool { return frame["id"] == "1" && frame["op"] == OpResult })
+	// The slot is free again once the handler returned
+	for busy := 1; busy > 0; time.Sleep(5 * time.Millisecond) {
+		m.mutex.Lock()
+		busy = 0
+		for client := range m.Clients {
+			busy += len(client.handlerSlots)
+		}
+		m.mutex.Unlock()
+	}
+	conn.WriteJSON(map[string]interface{}{"op": OpCall, "type": "wait", "id": "3"})
+	<-started
+	result := readFrame(t, conn, func(frame map[string]interface{}) bool { return frame["id"] == "3" })
+	if result["op"] != OpResult {
+		t.Fatalf("got %v, want the result", result)
+	}
+}
@@ -0,0 +1,133 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrUserOffline is returned by Call when the user has no connection on this node
+var ErrUserOffline = errors.New("user is not connected to this node")
+
+// ErrClientClosed is returned by Call when the connection closes before the result arrives
+var ErrClientClosed = errors.New("client disconnected")
+
+// CallError is an error result returned by a client
+type CallError struct {
+	Code    int
+	Message string
+}
+
+// Error returns the client's error message
+func (e *CallError) Error() string {
+	return fmt.Sprintf("call failed (code %d): %s", e.Code, e.Message)
+}
+
+// SetCallTimeout sets the timeout of server-to-client calls whose context has no deadline
+func (m *Manager) SetCallTimeout(timeout time.Duration) {
+	m.callTimeout = timeout
+}
+
+// SetHandlerTimeout sets the deadline of a handler's context. The handler keeps running
+// past it, but when it returns without having replied the message is answered with
+// error 1017. Zero disables the deadline.
+func (m *Manager) SetHandlerTimeout(timeout time.Duration) {
+	m.handlerTimeout = timeout
+}
+
+// SetHandlerLimit sets how many handlers of one client may run at once, 16 by default.
+// Messages beyond the limit are answered with error 1018. Zero removes the limit.
+func (m *Manager) SetHandlerLimit(limit int) {
+	m.handlerLimit = limit
+}
+
+// Call invokes a method on the most recently connected client of a user and waits for its result
+func (m *Manager) Call(ctx context.Context, userID, method string, params interface{}) (json.RawMessage, error) {
+	m.mutex.Lock()
+	var target *Client
+	for client := range m.users[userID] {
+		if target == nil || client.connectedAt.After(target.connectedAt) {
+			target = client
+		}
+	}
+	m.mutex.Unlock()
+
+	if target == nil {
+		return nil, ErrUserOffline
+	}
+	return target.Call(ctx, method, params)
+}
+
+// Call invokes a method on the client and waits for its result. The client receives
+// {"op":"call","type":method,"id":...,"data":params} and answers with a "result" command.
+func (c *Client) Call(ctx context.Context, method string, params interface{}) (json.RawMessage, error) {
+	raw, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := ctx.Deadline(); !ok && c.manager.callTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.manager.callTimeout)
+		defer cancel()
+	}
+
+	id := randomID(8)
+	result := make(chan *Envelope, 1)
+	c.callMu.Lock()
+	c.calls[id] = result
+	c.callMu.Unlock()
+	defer func() {
+		c.callMu.Lock()
+		delete(c.calls, id)
+		c.callMu.Unlock()
+	}()
+
+	c.sendEnvelope(&Envelope{Op: OpCall, Type: method, ID: id, Data: raw})
+	select {
+	case env := <-result:
+		if env.Code != 0 || env.Error != "" {
+			return nil, &CallError{Code: env.Code, Message: env.Error}
+		}
+		return json.RawMessage(env.Data), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.ctx.Done():
+		return nil, ErrClientClosed
+	}
+}
+
+// resolveCall hands a client's result to the waiting Call
+func (c *Client) resolveCall(env *Envelope) {
+	c.callMu.Lock()
+	result, ok := c.calls[env.ID]
+	c.callMu.Unlock()
+	if !ok {
+		c.manager.debugLog("Result for unknown or expired call", c.logArgs("call_id", env.ID)...)
+		return
+	}
+	// Duplicate results are ignored, the channel holds only the first one
+	select {
+	case result <- env:
+	default:
+	}
+}
+
+// handleCall runs the handler of a method called by the client and answers with its result
+func (c *Client) handleCall(env *Envelope) {
+	handler := c.manager.handler(env.Type)
+	if handler == nil {
+		c.replyError(env, 1008, fmt.Sprintf("Unknown method %q", env.Type))
+		return
+	}
+	c.dispatch(env, handler)
+}
+
+// handlerContext returns the context of a handler run, limited by the handler timeout
+func (c *Client) handlerContext() (context.Context, context.CancelFunc) {
+	if c.manager.handlerTimeout > 0 {
+		return context.WithTimeout(c.ctx, c.manager.handlerTimeout)
+	}
+	return context.WithCancel(c.ctx)
+}
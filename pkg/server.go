@@ -3,37 +3,62 @@ package pkg
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"net"
 	"net/http"
-	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 )
 
 // NewManager creates a new WebSocket manager
 func NewManager() *Manager {
-	return &Manager{
-		Clients:           make(map[*Client]bool),
-		Broadcast:         make(chan []byte),
-		BroadcastTopic:    make(chan *TopicResponse),
-		Register:          make(chan *Client),
-		Unregister:        make(chan *Client),
-		Subscribe:         make(chan *Subscription),
-		Unsubscribe:       make(chan *Subscription),
-		Errors:            make(chan *ErrorEvent, 100),      // Buffered error event channel
-		ConnEvents:        make(chan *ConnectionEvent, 100), // Buffered connection event channel
-		Topics:            make(map[string]map[*Client]bool),
-		shutdown:          make(chan struct{}),
-		isRunning:         false,
-		enableHeartbeat:   true,
-		heartbeatInterval: 5 * time.Second,  // 每5秒发送一次心跳
-		heartbeatTimeout:  15 * time.Second, // 15秒没有响应就认为超时
-		authEnabled:       false,
-		authFunc:          nil,
-		debug:             true, // 默认开启调试日志
+	m := &Manager{
+		Clients:            make(map[*Client]bool),
+		Broadcast:          make(chan []byte),
+		BroadcastTopic:     make(chan *TopicResponse),
+		publishes:          make(chan *publication),
+		Register:           make(chan *Client),
+		Unregister:         make(chan *Client),
+		Subscribe:          make(chan *Subscription),
+		Unsubscribe:        make(chan *Subscription),
+		Errors:             make(chan *ErrorEvent, 100),      // Buffered error event channel
+		ConnEvents:         make(chan *ConnectionEvent, 100), // Buffered connection event channel
+		SlowConsumers:      make(chan *SlowConsumerEvent, 100),
+		Topics:             make(map[string]map[*Client]bool),
+		topicTree:          newTopicTrie(),
+		users:              make(map[string]map[*Client]bool),
+		retained:           make(map[string]*TopicResponse),
+		retainFilters:      make(map[string]bool),
+		topicSeq:           make(map[string]uint64),
+		history:            make(map[string]*topicHistory),
+		sessions:           make(map[string]*session),
+		nodeID:             randomID(8),
+		interest:           make(map[string]int),
+		seen:               make(map[string]bool),
+		metrics:            newMetrics(),
+		shutdown:           make(chan struct{}),
+		isRunning:          false,
+		enableHeartbeat:    true,
+		heartbeatInterval:  5 * time.Second,  // 每5秒发送一次心跳
+		heartbeatTimeout:   15 * time.Second, // 15秒没有响应就认为超时
+		heartbeatMode:      HeartbeatPing,
+		legacyProtocol:     true,
+		legacyPublish:      true,
+		handlers:           make(map[string]HandlerFunc),
+		callTimeout:        30 * time.Second,
+		handlerLimit:       16,
+		sendBufferSize:     256,
+		slowConsumerPolicy: DefaultSlowConsumerPolicy,
+		codecs:             make(map[string]Codec),
 	}
+	m.RegisterCodec(JSONCodec{})
+	m.RegisterCodec(MsgpackCodec{})
+	m.RegisterCodec(ProtobufCodec{})
+	return m
 }
 
 // Start starts the WebSocket manager
@@ -47,14 +72,25 @@ func (m *Manager) Start() {
 			for client := range m.Clients {
 				client.conn.Close()
 			}
+			m.metrics.disconnected(disconnectShutdown, len(m.Clients))
 			m.Clients = make(map[*Client]bool)
 			m.Topics = make(map[string]map[*Client]bool)
+			m.topicTree = newTopicTrie()
+			m.users = make(map[string]map[*Client]bool)
 			m.mutex.Unlock()
 			m.isRunning = false
 			return
 		case client := <-m.Register:
 			m.mutex.Lock()
 			m.Clients[client] = true
+			m.metrics.connects.Add(1)
+			m.addUserClient(client)
+			m.presenceConnect(client)
+			client.scheduleExpiry()
+			if client.resumed != nil {
+				m.resumeSession(client, client.resumed)
+				client.resumed = nil
+			}
 			m.mutex.Unlock()
 
 			// Send connection event notification
@@ -68,10 +104,17 @@ func (m *Manager) Start() {
 			m.mutex.Lock()
 			if _, ok := m.Clients[client]; ok {
 				delete(m.Clients, client)
-				close(client.send)
-				for topic := range client.topics {
-					delete(m.Topics[topic], client)
-				}
+				reason := client.disconnectReason()
+				m.metrics.disconnected(reason, 1)
+				m.debugLog("Client disconnected", client.logArgs("reason", reason)...)
+				m.removeUserClient(client)
+				m.presenceDisconnect(client)
+				client.stopExpiry()
+				client.cancel()
+				client.closeSend()
+				m.detachSession(client)
+				m.removeClientTopics(client)
+				client.clearPending()
 
 				// Send disconnection event notification
 				m.ConnEvents <- &ConnectionEvent{
@@ -83,12 +126,45 @@ func (m *Manager) Start() {
 			}
 			m.mutex.Unlock()
 		case sub := <-m.Subscribe:
+			if !validTopicFilter(sub.topic) {
+				sub.client.rejectSubscription(sub, 1010, fmt.Sprintf("Invalid topic filter %q", sub.topic))
+				continue
+			}
+			if err := m.authorize(sub.client, ActionSubscribe, sub.topic); err != nil {
+				sub.client.rejectSubscription(sub, 1015, denyMessage(ActionSubscribe, sub.topic, err))
+				continue
+			}
+
 			m.mutex.Lock()
 			if _, ok := m.Topics[sub.topic]; !ok {
 				m.Topics[sub.topic] = make(map[*Client]bool)
 			}
+			if !sub.client.topics[sub.topic] {
+				m.addInterest(sub.topic)
+				m.presenceJoin(sub.client, sub.topic)
+			}
 			m.Topics[sub.topic][sub.client] = true
+			m.topicTree.add(sub.topic, sub.client)
 			sub.client.topics[sub.topic] = true
+			if sub.cmd != nil && sub.cmd.QoS > 0 {
+				sub.client.qos[sub.topic] = 1
+			} else {
+				delete(sub.client.qos, sub.topic)
+			}
+
+			if sub.cmd != nil {
+				sub.client.reply(sub.cmd, OpSubscribed)
+			}
+			if sub.cmd != nil && (sub.cmd.SinceSeq != nil || sub.cmd.SinceTime != nil) {
+				if store, ok := m.broker.(HistoryBroker); ok {
+					sub.client.replaying++
+					go m.replayBrokerHistory(store, sub.client, sub.topic, sub.cmd.SinceSeq, sub.cmd.SinceTime)
+				} else {
+					m.replayHistory(sub.client, sub.topic, sub.cmd.SinceSeq, sub.cmd.SinceTime)
+				}
+			} else {
+				m.sendRetained(sub.client, sub.topic)
+			}
 			m.mutex.Unlock()
 
 			// Send subscription event notification
@@ -102,8 +178,14 @@ func (m *Manager) Start() {
 		case unsub := <-m.Unsubscribe:
 			m.mutex.Lock()
 			if clients, ok := m.Topics[unsub.topic]; ok {
+				if clients[unsub.client] {
+					m.removeInterest(unsub.topic)
+					m.presenceLeave(unsub.client, unsub.topic)
+				}
 				delete(clients, unsub.client)
 				delete(unsub.client.topics, unsub.topic)
+				delete(unsub.client.qos, unsub.topic)
+				m.topicTree.remove(unsub.topic, unsub.client)
 
 				// Send unsubscription event notification
 				m.ConnEvents <- &ConnectionEvent{
@@ -115,40 +197,23 @@ func (m *Manager) Start() {
 				}
 			}
 			m.mutex.Unlock()
-		case message := <-m.Broadcast:
-			m.mutex.Lock()
-			fmt.Printf("-------------%v----------", string(message))
-			for client := range m.Clients {
-				select {
-				case client.send <- message:
-				default:
-					close(client.send)
-				}
+
+			if unsub.cmd != nil {
+				unsub.client.reply(unsub.cmd, OpUnsubscribed)
 			}
-			m.mutex.Unlock()
+		case message := <-m.Broadcast:
+			m.BroadcastMessage(message, nil)
 		case message := <-m.BroadcastTopic:
-			m.mutex.Lock()
-			if clients, ok := m.Topics[message.Topic]; ok {
-				messageBytes, err := json.Marshal(message)
-				if err != nil {
-					m.Errors <- &ErrorEvent{
-						Message: "Message serialization failed",
-						Code:    1001,
-						Time:    time.Now(),
-					}
-					log.Println("Message serialization failed:", err)
-					return
-				}
-				for client := range clients {
-					select {
-					case client.send <- messageBytes:
-					default:
-						close(client.send)
-						delete(clients, client)
-					}
-				}
+			m.publishTopic(message, nil)
+		case pub := <-m.publishes:
+			var exclude *Client
+			if pub.exclude {
+				exclude = pub.client
+			}
+			delivered := m.publishTopic(pub.message, exclude)
+			if pub.result != nil {
+				pub.result <- delivered
 			}
-			m.mutex.Unlock()
 		}
 	}
 }
@@ -168,68 +233,112 @@ func SetCustomUpgrader(customUpgrader websocket.Upgrader) {
 	upgrader = customUpgrader
 }
 
-// EnableAuth enables authentication using the provided function
-func (m *Manager) EnableAuth(authFunc func(r *http.Request) bool) {
-	m.authEnabled = true
-	m.authFunc = authFunc
-}
-
-// DisableAuth disables authentication
-func (m *Manager) DisableAuth() {
-	m.authEnabled = false
-	m.authFunc = nil
-}
-
 // HandleConnection handles WebSocket request
 func (m *Manager) HandleConnection(w http.ResponseWriter, r *http.Request) {
+	ctx, span := m.startConnectSpan(r)
+	defer span.End()
+
 	// Check authentication if enabled
-	if m.authEnabled && m.authFunc != nil {
-		if !m.authFunc(r) {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			m.Errors <- &ErrorEvent{
-				Message: "Authentication failed",
-				Code:    1007,
-				Time:    time.Now(),
-			}
-			return
-		}
+	authCtx, authSpan := m.tracer().Start(ctx, "tkws.authenticate")
+	principal, ok := m.authenticate(w, r.WithContext(authCtx))
+	if !ok {
+		authSpan.SetStatus(codes.Error, "authentication failed")
+		authSpan.End()
+		span.SetStatus(codes.Error, "authentication failed")
+		return
 	}
+	authSpan.End()
 
 	// Upgrade HTTP connection to WebSocket connection
-	conn, err := upgrader.Upgrade(w, r, nil)
+	wsUpgrader := upgrader
+	if len(wsUpgrader.Subprotocols) == 0 {
+		wsUpgrader.Subprotocols = m.subprotocols()
+	}
+	_, upgradeSpan := m.tracer().Start(ctx, "tkws.upgrade")
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	endSpan(upgradeSpan, err)
 	if err != nil {
-		m.Errors <- &ErrorEvent{
+		span.SetStatus(codes.Error, "connection upgrade failed")
+		m.reportError(&ErrorEvent{
 			Message: "Connection upgrade failed",
 			Code:    1002,
 			Time:    time.Now(),
-		}
-		log.Println("Connection upgrade failed:", err)
+		}, "remote_addr", r.RemoteAddr, "error", err)
 		return
 	}
 
-	// 生成唯一的客户端ID
+	// 生成唯一的客户端ID，认证后只信任 Principal 中的用户ID
 	clientID := r.URL.Query().Get("user_id")
+	if principal != nil {
+		clientID = principal.UserID
+	}
+
+	// Resume a detached session if the client presents its token
+	var resumed *session
+	if token := r.URL.Query().Get("session"); token != "" && m.sessionResume {
+		if resumed = m.claimSession(token, clientID); resumed != nil {
+			clientID = resumed.userID
+		}
+	}
+
 	if clientID == "" {
 		clientID = fmt.Sprintf("client_%d", time.Now().UnixNano())
 	}
+	// The client's principal always carries its final user ID
+	identity := Principal{UserID: clientID}
+	if principal != nil {
+		identity = *principal
+		identity.UserID = clientID
+	}
 
 	// Create new client
 	client := &Client{
-		manager: m,
-		conn:    conn,
-		send:    make(chan []byte, 256),
-		userID:  clientID,
-		topics:  make(map[string]bool),
+		manager:     m,
+		id:          randomID(8),
+		conn:        conn,
+		send:        make(chan outbound, m.sendBufferSize),
+		room:        make(chan struct{}, 1),
+		policy:      m.slowConsumerPolicy,
+		userID:      clientID,
+		topics:      make(map[string]bool),
+		qos:         make(map[string]int),
+		pending:     make(map[string]*pendingMessage),
+		codec:       m.codecFor(conn.Subprotocol()),
+		resumed:     resumed,
+		connectedAt: time.Now(),
+		principal:   &identity,
+		calls:       make(map[string]chan *Envelope),
+	}
+	client.ctx, client.cancel = context.WithCancel(context.Background())
+	if m.handlerLimit > 0 {
+		client.handlerSlots = make(chan struct{}, m.handlerLimit)
+	}
+	if resumed != nil {
+		client.sessionToken = resumed.token
+	} else if m.sessionResume {
+		client.sessionToken = randomID(16)
 	}
 
+	span.SetAttributes(
+		attribute.String("tkws.client_id", client.id),
+		attribute.String("tkws.user_id", clientID),
+		attribute.String("tkws.codec", client.codec.Name()),
+	)
+
 	// 发送欢迎消息
-	welcomeMsg := fmt.Sprintf("Hello, %s! Welcome to WebSocket server.", clientID)
-	if err := conn.WriteMessage(websocket.TextMessage, []byte(welcomeMsg)); err != nil {
-		m.debugLog("Failed to send welcome message: %v", err)
+	if err := client.writeWelcome(); err != nil {
+		span.RecordError(err)
+		m.debugLog("Failed to send welcome message", client.logArgs("error", err)...)
+		if resumed != nil {
+			m.mutex.Lock()
+			m.releaseSessionInterest(resumed)
+			m.mutex.Unlock()
+		}
+		client.cancel()
 		conn.Close()
 		return
 	}
-	m.debugLog("Sent welcome message to client %s", clientID)
+	m.debugLog("Client connected", client.logArgs("codec", client.codec.Name(), "resumed", resumed != nil)...)
 
 	// Register new client
 	client.manager.Register <- client
@@ -252,20 +361,33 @@ func (c *Client) readPump() {
 	for {
 		_, message, err := c.conn.ReadMessage()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				c.manager.Errors <- &ErrorEvent{
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				c.setLeaveReason(disconnectHeartbeat)
+				c.manager.metrics.heartbeatFailures.Add(1)
+				c.manager.reportError(&ErrorEvent{
+					Client:  c,
+					Message: fmt.Sprintf("Heartbeat timeout, no response within %v", c.manager.heartbeatTimeout),
+					Code:    1005,
+					Time:    time.Now(),
+				})
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				c.setLeaveReason(disconnectReadError)
+				c.manager.reportError(&ErrorEvent{
 					Client:  c,
 					Message: fmt.Sprintf("Read message error: %v", err),
 					Code:    1003,
 					Time:    time.Now(),
-				}
-				c.manager.debugLog("Client %s: Read error: %v", c.userID, err)
+				})
 			}
 			break
 		}
+		c.extendReadDeadline()
+		c.manager.metrics.received(len(message))
 
-		msgStr := string(message)
-		c.manager.debugLog("Client %s: Received message: %s", c.userID, msgStr)
+		if c.manager.debug {
+			c.manager.debugLog("Received message", c.logArgs(c.manager.payloadArgs(message)...)...)
+		}
 
 		// 尝试解析JSON消息
 		var msgMap map[string]interface{}
@@ -276,32 +398,7 @@ func (c *Client) readPump() {
 			}
 		}
 
-		// Handle subscription message
-		if strings.HasPrefix(msgStr, "sub:") {
-			topic := msgStr[4:]
-			c.manager.debugLog("Client %s: Subscribing to topic: %s", c.userID, topic)
-			c.manager.Subscribe <- &Subscription{client: c, topic: topic}
-		} else if strings.HasPrefix(msgStr, "unsub:") {
-			topic := msgStr[6:]
-			c.manager.debugLog("Client %s: Unsubscribing from topic: %s", c.userID, topic)
-			c.manager.Unsubscribe <- &Subscription{client: c, topic: topic}
-		} else {
-			// 广播消息给其他客户端
-			c.manager.debugLog("Client %s: Broadcasting message to other clients: %s", c.userID, msgStr)
-			c.manager.mutex.Lock()
-			for client := range c.manager.Clients {
-				// 不发送给消息发送者自己
-				if client != c {
-					select {
-					case client.send <- message:
-					default:
-						close(client.send)
-						delete(c.manager.Clients, client)
-					}
-				}
-			}
-			c.manager.mutex.Unlock()
-		}
+		c.handleMessage(message)
 	}
 }
 
@@ -311,58 +408,217 @@ func (c *Client) writePump() {
 		c.conn.Close()
 	}()
 
+	// Heartbeats are written here so they never race with other writes
+	var heartbeat <-chan time.Time
+	if c.manager.enableHeartbeat {
+		ticker := time.NewTicker(c.manager.heartbeatInterval)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+
 	for {
-		message, ok := <-c.send
-		if !ok {
-			// Channel is closed
-			c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-			return
-		}
+		select {
+		case out, ok := <-c.send:
+			c.signalRoom()
+			if !ok {
+				// Channel is closed
+				c.conn.WriteMessage(websocket.CloseMessage, c.closeMessage())
+				return
+			}
 
-		err := c.conn.WriteMessage(websocket.TextMessage, message)
-		if err != nil {
-			c.manager.Errors <- &ErrorEvent{
-				Client:  c,
-				Message: fmt.Sprintf("Write message error: %v", err),
-				Code:    1004,
-				Time:    time.Now(),
+			message := out.frame
+			write := c.manager.startWriteSpan(out)
+			messageType := c.messageType()
+			if out.raw {
+				messageType = websocket.TextMessage
+			}
+			err := c.conn.WriteMessage(messageType, message)
+			endSpan(write, err)
+			endSpan(out.span, err)
+			if err != nil {
+				c.setLeaveReason(disconnectWriteError)
+				c.manager.reportError(&ErrorEvent{
+					Client:  c,
+					Message: fmt.Sprintf("Write message error: %v", err),
+					Code:    1004,
+					Time:    time.Now(),
+				})
+				return
+			}
+			c.manager.metrics.sent(len(message))
+			if c.manager.debug {
+				c.manager.debugLog("Sent message", c.logArgs(c.manager.payloadArgs(message)...)...)
+			}
+		case <-heartbeat:
+			if err := c.writeHeartbeat(); err != nil {
+				c.setLeaveReason(disconnectHeartbeat)
+				c.manager.metrics.heartbeatFailures.Add(1)
+				c.manager.reportError(&ErrorEvent{
+					Client:  c,
+					Message: fmt.Sprintf("Heartbeat failed: %v", err),
+					Code:    1005,
+					Time:    time.Now(),
+				})
+				return
 			}
-			c.manager.debugLog("Client %s: Write error: %v", c.userID, err)
-			return
 		}
-		c.manager.debugLog("Client %s: Sent message: %s", c.userID, string(message))
 	}
 }
 
 // BroadcastMessage broadcasts a message to all connected clients except the excluded one
 func (m *Manager) BroadcastMessage(message []byte, excludeClient *Client) {
-	excludeID := "none"
-	if excludeClient != nil {
-		excludeID = excludeClient.userID
+	if m.debug {
+		args := m.payloadArgs(message)
+		if excludeClient != nil {
+			args = excludeClient.logArgs(args...)
+		}
+		m.debugLog("Broadcasting message to all clients", args...)
 	}
-	m.debugLog("Broadcasting message to all clients (except %s): %s", excludeID, string(message))
 
+	m.broadcastLocal(message, excludeClient)
+	m.publishToBroker(&BrokerMessage{Kind: BrokerBroadcast, Data: message})
+}
+
+// broadcastLocal sends a message to the clients of this node except the excluded one
+func (m *Manager) broadcastLocal(message []byte, excludeClient *Client) {
 	m.mutex.Lock()
+	defer m.mutex.Unlock()
 	for client := range m.Clients {
 		if excludeClient == nil || client != excludeClient {
-			select {
-			case client.send <- message:
-			default:
-				close(client.send)
-				delete(m.Clients, client)
-			}
+			client.enqueueRaw(message)
 		}
 	}
-	m.mutex.Unlock()
 }
 
 // BroadcastTopicMessage broadcasts a message to all subscribers of a specific topic
 func (m *Manager) BroadcastTopicMessage(topic string, data string) {
-	m.debugLog("Broadcasting message to topic %s: %s", topic, data)
-	m.BroadcastTopic <- &TopicResponse{
+	m.BroadcastTopicMessageContext(context.Background(), topic, data)
+}
+
+// BroadcastTopicMessageContext broadcasts a message to all subscribers of a specific topic,
+// the publish span continues the trace in ctx and is carried to every delivery
+func (m *Manager) BroadcastTopicMessageContext(ctx context.Context, topic string, data string) {
+	if m.debug {
+		m.debugLog("Broadcasting message to topic", append([]any{"topic", topic}, m.payloadArgs([]byte(data))...)...)
+	}
+	message := &TopicResponse{
 		Topic: topic,
 		Data:  data,
 	}
+	span := m.startPublishSpan(ctx, message, nil)
+	defer span.End()
+	m.BroadcastTopic <- message
+}
+
+// PublishTopicMessage publishes a message to a topic like BroadcastTopicMessageContext,
+// waits until it is delivered on this node and returns the number of local subscribers
+// that received it. If ctx is done first it returns ctx.Err(), the message may still
+// be published if it was already handed to the manager.
+func (m *Manager) PublishTopicMessage(ctx context.Context, topic string, data string) (int, error) {
+	message := &TopicResponse{
+		Topic: topic,
+		Data:  data,
+	}
+	span := m.startPublishSpan(ctx, message, nil)
+	defer span.End()
+
+	result := make(chan int, 1)
+	select {
+	case m.publishes <- &publication{message: message, result: result}:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+	select {
+	case delivered := <-result:
+		return delivered, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// publishTopic relays a topic message to the cluster and delivers it locally,
+// skipping the exclude client if set
+func (m *Manager) publishTopic(message *TopicResponse, exclude *Client) int {
+	// Number the message before relaying it, so every node delivers the same seq
+	m.mutex.Lock()
+	m.assignSeq(message)
+	m.mutex.Unlock()
+
+	relayed := *message
+	m.publishToBroker(&BrokerMessage{Kind: BrokerTopic, Topic: message.Topic, Message: &relayed})
+	// A HistoryBroker assigns the sequence number when storing the message
+	message.Seq = relayed.Seq
+	return m.deliverTopic(message, exclude)
+}
+
+// deliverTopic sends a topic message once to every client with a matching filter
+// except exclude and returns the number of recipients
+func (m *Manager) deliverTopic(message *TopicResponse, exclude *Client) int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.ackDelivery && message.ID == "" {
+		message.ID = randomID(8)
+	}
+	m.recordMessage(message)
+	m.retainMessage(message)
+	m.queueForSessions(message)
+
+	recipients := make(map[*Client]bool)
+	m.topicTree.match(message.Topic, recipients)
+	delete(recipients, exclude)
+
+	ctx, span := m.startFanoutSpan(message)
+	defer span.End()
+
+	delivered := 0
+	frames := make(map[string][]byte)
+	for client := range recipients {
+		if client.replaying > 0 {
+			// Sent after the history the client is waiting for
+			client.held = append(client.held, message)
+			delivered++
+			continue
+		}
+		if m.sendTopicFrame(ctx, client, frames, message) {
+			delivered++
+		}
+	}
+	span.SetAttributes(attribute.Int("tkws.recipients", len(recipients)), attribute.Int("tkws.delivered", delivered))
+	return delivered
+}
+
+// sendTopicFrame encodes a topic message for one client and queues it,
+// frames caches encodings per codec. The caller must hold the mutex.
+func (m *Manager) sendTopicFrame(ctx context.Context, client *Client, frames map[string][]byte, message *TopicResponse) bool {
+	span := m.startDeliverSpan(ctx, client, message)
+	messageBytes, err := encodeFrame(frames, client.codec, message)
+	if err != nil {
+		endSpan(span, err)
+		m.reportError(&ErrorEvent{
+			Client:  client,
+			Message: "Message serialization failed",
+			Code:    1001,
+			Time:    time.Now(),
+		}, "topic", message.Topic, "error", err)
+		return false
+	}
+	if !client.enqueueOutbound(outbound{frame: messageBytes, span: span}) {
+		return false
+	}
+	m.trackDelivery(client, message)
+	return true
+}
+
+// removeClientTopics drops all subscriptions of a client, the caller must hold the mutex
+func (m *Manager) removeClientTopics(client *Client) {
+	for topic := range client.topics {
+		delete(m.Topics[topic], client)
+		m.topicTree.remove(topic, client)
+		m.removeInterest(topic)
+		delete(client.topics, topic)
+		delete(client.qos, topic)
+	}
 }
 
 // SetHTTPServer sets HTTP server reference for shutdown
@@ -378,7 +634,19 @@ func (m *Manager) Shutdown(ctx context.Context) error {
 
 	// Notify all clients of imminent shutdown
 	closeMessage := []byte("Server is shutting down")
-	m.BroadcastMessage(closeMessage, nil)
+	m.broadcastLocal(closeMessage, nil)
+
+	// Leave the cluster after the queued presence and broker updates
+	m.syncCluster()
+	m.mutex.Lock()
+	broker, presence := m.broker, m.presence
+	m.mutex.Unlock()
+	if broker != nil {
+		broker.Close()
+	}
+	if presence != nil {
+		presence.ClearNode(m.nodeID)
+	}
 
 	// Send shutdown signal
 	m.shutdown <- struct{}{}
@@ -424,24 +692,52 @@ func (m *Manager) IsRunning() bool {
 	return m.isRunning
 }
 
-// CloseClient closes the connection to a specific client
+// CloseClient closes every connection of a specific user. With a presence registry,
+// connections on other nodes are closed through the broker.
 func (m *Manager) CloseClient(userID string) bool {
+	closed := m.closeUserLocal(userID)
+
 	m.mutex.Lock()
-	defer m.mutex.Unlock()
+	presence := m.presence
+	m.mutex.Unlock()
+	if presence == nil {
+		return closed
+	}
 
-	for client := range m.Clients {
-		if client.userID == userID {
-			client.conn.Close()
+	conns, err := presence.UserConnections(userID)
+	if err != nil {
+		m.log().Warn("Presence lookup failed", "user_id", userID, "error", err)
+		return closed
+	}
+	for _, conn := range conns {
+		if conn.NodeID != m.nodeID {
+			m.publishToBroker(&BrokerMessage{Kind: BrokerClose, UserID: userID})
 			return true
 		}
 	}
-	return false
+	return closed
+}
+
+// closeUserLocal closes the user's connections on this node
+func (m *Manager) closeUserLocal(userID string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for client := range m.users[userID] {
+		client.setLeaveReason(disconnectKicked)
+		client.conn.Close()
+	}
+	return len(m.users[userID]) > 0
 }
 
-// EnableHeartbeat enables the heartbeat mechanism with specified interval
+// EnableHeartbeat enables the heartbeat mechanism with specified interval.
+// The timeout is raised to three intervals if it is not longer than the interval.
 func (m *Manager) EnableHeartbeat(interval time.Duration) {
 	m.enableHeartbeat = true
 	m.heartbeatInterval = interval
+	if m.heartbeatTimeout <= interval {
+		m.heartbeatTimeout = 3 * interval
+	}
 }
 
 // DisableHeartbeat disables the heartbeat mechanism
@@ -449,73 +745,49 @@ func (m *Manager) DisableHeartbeat() {
 	m.enableHeartbeat = false
 }
 
-// startHeartbeat starts the heartbeat mechanism for a client
+// SetHeartbeatTimeout sets how long a client may stay silent before it is disconnected
+func (m *Manager) SetHeartbeatTimeout(timeout time.Duration) {
+	m.heartbeatTimeout = timeout
+}
+
+// SetHeartbeatMode selects WebSocket ping frames or application-level JSON heartbeats
+func (m *Manager) SetHeartbeatMode(mode HeartbeatMode) {
+	m.heartbeatMode = mode
+}
+
+// startHeartbeat arms the read deadline, every pong or incoming message extends it
 func (c *Client) startHeartbeat() {
 	if !c.manager.enableHeartbeat {
-		c.manager.debugLog("Client %s: Heartbeat is disabled", c.userID)
+		c.manager.debugLog("Heartbeat is disabled", c.logArgs()...)
 		return
 	}
 
-	c.manager.debugLog("Client %s: Starting heartbeat with interval %v",
-		c.userID, c.manager.heartbeatInterval)
-
-	// 启动心跳发送goroutine
-	go func() {
-		// 等待一小段时间再开始发送心跳，避免连接建立后立即发送
-		time.Sleep(1 * time.Second)
-
-		ticker := time.NewTicker(c.manager.heartbeatInterval)
-		defer ticker.Stop()
+	c.manager.debugLog("Starting heartbeat", c.logArgs(
+		"mode", c.manager.heartbeatMode,
+		"interval", c.manager.heartbeatInterval,
+		"timeout", c.manager.heartbeatTimeout)...)
 
-		consecutiveFailures := 0 // 连续发送失败次数
-		maxFailures := 3         // 最大允许的连续失败次数
-
-		for {
-			select {
-			case <-ticker.C:
-
-				// 尝试发送心跳消息
-				if err := c.conn.WriteMessage(websocket.TextMessage, []byte("heartbeat")); err != nil {
-					consecutiveFailures++
-					c.manager.debugLog("Client %s: Failed to send heartbeat (%d/%d failures): %v",
-						c.userID, consecutiveFailures, maxFailures, err)
-
-					if consecutiveFailures >= maxFailures {
-						c.manager.debugLog("Client %s: Too many consecutive heartbeat failures, closing connection", c.userID)
-						c.manager.Errors <- &ErrorEvent{
-							Client:  c,
-							Message: fmt.Sprintf("Heartbeat failed %d times consecutively", consecutiveFailures),
-							Code:    1005,
-							Time:    time.Now(),
-						}
-						c.conn.Close()
-						return
-					}
-				} else {
-					// 发送成功，重置失败计数
-					if consecutiveFailures > 0 {
-						c.manager.debugLog("Client %s: Heartbeat restored after %d failures", c.userID, consecutiveFailures)
-					}
-					consecutiveFailures = 0
-				}
-			}
-		}
-	}()
+	c.extendReadDeadline()
+	c.conn.SetPongHandler(func(string) error {
+		c.extendReadDeadline()
+		return nil
+	})
 }
 
-// EnableDebug enables debug logging
-func (m *Manager) EnableDebug() {
-	m.debug = true
-}
-
-// DisableDebug disables debug logging
-func (m *Manager) DisableDebug() {
-	m.debug = false
+// extendReadDeadline pushes the read deadline one heartbeat timeout ahead
+func (c *Client) extendReadDeadline() {
+	if c.manager.enableHeartbeat {
+		c.conn.SetReadDeadline(time.Now().Add(c.manager.heartbeatTimeout))
+	}
 }
 
-// debugLog prints debug message if debug is enabled
-func (m *Manager) debugLog(format string, v ...interface{}) {
-	if m.debug {
-		log.Printf(format, v...)
+// writeHeartbeat sends a ping frame or a JSON heartbeat, it is only called from writePump
+func (c *Client) writeHeartbeat() error {
+	deadline := time.Now().Add(c.manager.heartbeatTimeout)
+	if c.manager.heartbeatMode == HeartbeatJSON {
+		c.conn.SetWriteDeadline(deadline)
+		defer c.conn.SetWriteDeadline(time.Time{})
+		return c.conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"heartbeat"}`))
 	}
+	return c.conn.WriteControl(websocket.PingMessage, nil, deadline)
 }
@@ -0,0 +1,176 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// session keeps the subscriptions and undelivered topic messages of a
+// disconnected client until it resumes or the grace window expires
+type session struct {
+	token   string
+	userID  string
+	topics  []string
+	qos     map[string]int
+	queue   []*TopicResponse
+	dropped int
+	timer   *time.Timer
+}
+
+// EnableSessionResume lets clients resume their subscriptions within the grace window
+// after a disconnect, queueing up to queueSize topic messages in the meantime
+func (m *Manager) EnableSessionResume(grace time.Duration, queueSize int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.sessionResume = true
+	m.sessionGrace = grace
+	m.sessionQueueSize = queueSize
+}
+
+// DisableSessionResume stops issuing session tokens and drops detached sessions
+func (m *Manager) DisableSessionResume() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.sessionResume = false
+	for token, s := range m.sessions {
+		s.timer.Stop()
+		delete(m.sessions, token)
+		m.releaseSessionInterest(s)
+	}
+}
+
+// claimSession takes a detached session for a reconnecting client. The user ID,
+// when given, must match the one the session was issued to.
+func (m *Manager) claimSession(token string, userID string) *session {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	s, ok := m.sessions[token]
+	if !ok || (userID != "" && userID != s.userID) {
+		return nil
+	}
+	s.timer.Stop()
+	delete(m.sessions, token)
+	return s
+}
+
+// releaseSessionInterest drops the topic interest held by a detached session,
+// the caller must hold the mutex. A claimed session keeps it until it is resumed.
+func (m *Manager) releaseSessionInterest(s *session) {
+	for _, topic := range s.topics {
+		m.removeInterest(topic)
+	}
+}
+
+// detachSession keeps a disconnected client's subscriptions for the grace window,
+// the caller must hold the mutex
+func (m *Manager) detachSession(client *Client) {
+	if !m.sessionResume || client.sessionToken == "" {
+		return
+	}
+
+	s := &session{
+		token:  client.sessionToken,
+		userID: client.userID,
+		topics: make([]string, 0, len(client.topics)),
+		qos:    make(map[string]int),
+		// Unacknowledged messages are delivered again on resume
+		queue: client.pendingMessages(),
+	}
+	for topic := range client.topics {
+		s.topics = append(s.topics, topic)
+		// Keep receiving cluster traffic for the queue
+		m.addInterest(topic)
+	}
+	for topic, qos := range client.qos {
+		s.qos[topic] = qos
+	}
+	s.timer = time.AfterFunc(m.sessionGrace, func() {
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		if m.sessions[s.token] == s {
+			delete(m.sessions, s.token)
+			m.releaseSessionInterest(s)
+			m.debugLog("Session expired", "user_id", s.userID)
+		}
+	})
+	m.sessions[s.token] = s
+	m.debugLog("Session detached", client.logArgs("grace", m.sessionGrace)...)
+}
+
+// queueForSessions queues a topic message for detached sessions subscribed to it,
+// dropping the oldest message when a queue is full. The caller must hold the mutex.
+func (m *Manager) queueForSessions(message *TopicResponse) {
+	for _, s := range m.sessions {
+		for _, filter := range s.topics {
+			if !TopicMatches(filter, message.Topic) {
+				continue
+			}
+			if m.sessionQueueSize <= 0 {
+				s.dropped++
+				break
+			}
+			if len(s.queue) >= m.sessionQueueSize {
+				s.queue = s.queue[1:]
+				s.dropped++
+			}
+			queued := *message
+			s.queue = append(s.queue, &queued)
+			break
+		}
+	}
+}
+
+// resumeSession restores a resumed session's subscriptions on its new client and
+// flushes the queued messages. The caller must hold the mutex.
+func (m *Manager) resumeSession(client *Client, s *session) {
+	for _, topic := range s.topics {
+		// The principal may have lost access since the session was detached
+		if err := m.authorizeWith(m.authorizer, client, ActionSubscribe, topic); err != nil {
+			m.reportDenied(client, ActionSubscribe, topic, err)
+			continue
+		}
+		if _, ok := m.Topics[topic]; !ok {
+			m.Topics[topic] = make(map[*Client]bool)
+		}
+		m.Topics[topic][client] = true
+		m.topicTree.add(topic, client)
+		m.addInterest(topic)
+		m.presenceJoin(client, topic)
+		client.topics[topic] = true
+	}
+	m.releaseSessionInterest(s)
+	for topic, qos := range s.qos {
+		if client.topics[topic] {
+			client.qos[topic] = qos
+		}
+	}
+
+	for _, message := range s.queue {
+		if client.subscribedTo(message.Topic) {
+			m.sendTopicFrame(context.Background(), client, make(map[string][]byte), message)
+		}
+	}
+
+	if s.dropped > 0 {
+		m.reportError(&ErrorEvent{
+			Client:  client,
+			Message: fmt.Sprintf("Session queue overflowed, %d messages dropped", s.dropped),
+			Code:    1011,
+			Time:    time.Now(),
+		})
+	}
+	m.debugLog("Session resumed", client.logArgs("topics", len(s.topics), "queued", len(s.queue))...)
+}
+
+// subscribedTo reports whether one of the client's filters matches a topic,
+// the caller must hold the mutex
+func (c *Client) subscribedTo(topic string) bool {
+	for filter := range c.topics {
+		if TopicMatches(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
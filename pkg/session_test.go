@@ -0,0 +1,150 @@
+package pkg
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialSession connects with a query string and returns the welcome frame
+func dialSession(t *testing.T, url, query string) (*websocket.Conn, map[string]interface{}) {
+	t.Helper()
+	conn := dialTest(t, url+"?"+query)
+	welcome := readFrame(t, conn, func(frame map[string]interface{}) bool { return frame["op"] == OpWelcome })
+	return conn, welcome
+}
+
+// waitDisconnected waits until the manager has unregistered every client
+func waitDisconnected(t *testing.T, m *Manager) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for m.GetClientCount() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("client was not unregistered")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// waitError reads error events until one has the code
+func waitError(t *testing.T, m *Manager, code int) *ErrorEvent {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-m.Errors:
+			if event.Code == code {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("no error event with code %d", code)
+		}
+	}
+}
+
+// detached reports whether a session is waiting to be resumed
+func detached(m *Manager, token string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	_, ok := m.sessions[token]
+	return ok
+}
+
+// detachedSession subscribes a client to news, disconnects it and returns its session token
+func detachedSession(t *testing.T, m *Manager, url string) string {
+	t.Helper()
+	conn, welcome := dialSession(t, url, "user_id=alice")
+	token, _ := welcome["session"].(string)
+	if token == "" {
+		t.Fatalf("welcome %v carries no session token", welcome)
+	}
+	subscribeTest(t, conn, "news")
+	conn.Close()
+	waitDisconnected(t, m)
+	return token
+}
+
+func TestSessionResume(t *testing.T) {
+	m, _, url := startTestManager(t)
+	m.EnableSessionResume(time.Minute, 10)
+	token := detachedSession(t, m, url)
+
+	m.PublishTopicMessage(context.Background(), "news", "queued1")
+	m.PublishTopicMessage(context.Background(), "news", "queued2")
+
+	// Another user cannot take over the session
+	_, welcome := dialSession(t, url, "session="+token+"&user_id=mallory")
+	if welcome["resumed"] == true || welcome["session"] == token {
+		t.Fatalf("session resumed by another user: %v", welcome)
+	}
+
+	conn, welcome := dialSession(t, url, "session="+token)
+	if welcome["resumed"] != true || welcome["user_id"] != "alice" || welcome["session"] != token {
+		t.Fatalf("welcome %v, want alice's resumed session", welcome)
+	}
+	for _, want := range []string{"queued1", "queued2"} {
+		frame := readFrame(t, conn, func(frame map[string]interface{}) bool { return frame["topic"] == "news" })
+		if frame["data"] != want {
+			t.Fatalf("queued message %v, want %s", frame["data"], want)
+		}
+	}
+
+	// The subscription was restored
+	m.PublishTopicMessage(context.Background(), "news", "live")
+	readFrame(t, conn, func(frame map[string]interface{}) bool { return frame["data"] == "live" })
+	if detached(m, token) {
+		t.Fatal("resumed session is still detached")
+	}
+}
+
+func TestSessionGraceExpiry(t *testing.T) {
+	m, _, url := startTestManager(t)
+	m.EnableSessionResume(50*time.Millisecond, 10)
+	token := detachedSession(t, m, url)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if !detached(m, token) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("session outlived its grace window")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	m.mutex.Lock()
+	interest := m.interest["news"]
+	m.mutex.Unlock()
+	if interest != 0 {
+		t.Fatalf("expired session still holds %d interest in news", interest)
+	}
+
+	_, welcome := dialSession(t, url, "session="+token)
+	if welcome["resumed"] == true || welcome["session"] == token {
+		t.Fatalf("expired session was resumed: %v", welcome)
+	}
+}
+
+func TestSessionQueueOverflow(t *testing.T) {
+	m, _, url := startTestManager(t)
+	m.EnableSessionResume(time.Minute, 2)
+	token := detachedSession(t, m, url)
+
+	for _, data := range []string{"1", "2", "3"} {
+		m.PublishTopicMessage(context.Background(), "news", data)
+	}
+
+	conn, _ := dialSession(t, url, "session="+token)
+	// The oldest message was dropped
+	for _, want := range []string{"2", "3"} {
+		frame := readFrame(t, conn, func(frame map[string]interface{}) bool { return frame["topic"] == "news" })
+		if frame["data"] != want {
+			t.Fatalf("queued message %v, want %s", frame["data"], want)
+		}
+	}
+	if event := waitError(t, m, 1011); event.Message != "Session queue overflowed, 1 messages dropped" {
+		t.Fatalf("overflow reported as %q", event.Message)
+	}
+}
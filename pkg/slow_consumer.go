@@ -0,0 +1,292 @@
+package pkg
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// SlowConsumerAction decides what happens when a client's send buffer is full
+type SlowConsumerAction string
+
+const (
+	// SlowConsumerDisconnect closes the connection with the policy's close code
+	SlowConsumerDisconnect SlowConsumerAction = "disconnect"
+	// SlowConsumerDropOldest discards the oldest queued frame to make room
+	SlowConsumerDropOldest SlowConsumerAction = "drop_oldest"
+	// SlowConsumerDropNewest discards the frame being sent
+	SlowConsumerDropNewest SlowConsumerAction = "drop_newest"
+	// SlowConsumerBlock queues frames behind the full buffer, up to the buffer size, and
+	// disconnects when the client does not make room within the policy's timeout
+	SlowConsumerBlock SlowConsumerAction = "block"
+)
+
+// SlowConsumerPolicy configures how a full send buffer is handled
+type SlowConsumerPolicy struct {
+	Action    SlowConsumerAction
+	CloseCode int           // Close code sent when disconnecting
+	Timeout   time.Duration // How long SlowConsumerBlock waits for the client to make room
+}
+
+// DefaultSlowConsumerPolicy disconnects slow clients with "try again later"
+var DefaultSlowConsumerPolicy = SlowConsumerPolicy{
+	Action:    SlowConsumerDisconnect,
+	CloseCode: websocket.CloseTryAgainLater,
+}
+
+// SlowConsumerEvent reports frames dropped for a slow client
+type SlowConsumerEvent struct {
+	Client       *Client            `json:"-"`
+	UserID       string             `json:"user_id"`
+	Action       SlowConsumerAction `json:"action"`
+	Dropped      int                `json:"dropped"`       // Frames dropped by this event
+	TotalDropped uint64             `json:"total_dropped"` // Frames dropped for the client so far
+	Time         time.Time          `json:"time"`
+}
+
+// SetSlowConsumerPolicy sets the policy for connections created afterwards
+func (m *Manager) SetSlowConsumerPolicy(policy SlowConsumerPolicy) {
+	m.slowConsumerPolicy = policy
+}
+
+// SetSendBufferSize sets the send buffer size for connections created afterwards
+func (m *Manager) SetSendBufferSize(size int) {
+	m.sendBufferSize = size
+}
+
+// SetSlowConsumerPolicy overrides the manager's policy for this client
+func (c *Client) SetSlowConsumerPolicy(policy SlowConsumerPolicy) {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	c.policy = policy
+}
+
+// DroppedCount gets the number of frames dropped for this client
+func (c *Client) DroppedCount() uint64 {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	return c.dropped
+}
+
+// SendBufferDepth gets the number of frames waiting in the send buffer and behind it
+func (c *Client) SendBufferDepth() int {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	return len(c.send) + len(c.overflow)
+}
+
+// enqueue queues a frame for the write pump, applying the slow consumer policy
+// when the buffer is full. It never sends on a closed channel.
+func (c *Client) enqueue(frame []byte) bool {
+	return c.enqueueOutbound(outbound{frame: frame})
+}
+
+// enqueueRaw queues a payload that is not encoded by the client's codec, such as a
+// broadcast, it is written as a text frame for binary codecs too
+func (c *Client) enqueueRaw(payload []byte) bool {
+	return c.enqueueOutbound(outbound{frame: payload, raw: true})
+}
+
+// enqueueOutbound queues a frame with its delivery span, the span is ended
+// here if the frame is not queued
+func (c *Client) enqueueOutbound(out outbound) bool {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	if c.sendClosed {
+		endSpan(out.span, ErrClientClosed)
+		return false
+	}
+	// Queued frames go first, the buffer only takes new ones once the overflow drained
+	if len(c.overflow) == 0 {
+		select {
+		case c.send <- out:
+			c.manager.metrics.observeDepth(len(c.send))
+			return true
+		default:
+		}
+	}
+
+	switch c.policy.Action {
+	case SlowConsumerDropNewest:
+		out.drop()
+		c.reportDrop(1)
+		return false
+	case SlowConsumerDropOldest:
+		select {
+		case oldest := <-c.send:
+			oldest.drop()
+		default:
+		}
+		select {
+		case c.send <- out:
+			c.manager.metrics.observeDepth(len(c.send))
+			c.reportDrop(1)
+			return true
+		default:
+			out.drop()
+			c.reportDrop(2)
+			return false
+		}
+	case SlowConsumerBlock:
+		// Callers often hold the manager's mutex, so the waiting happens in drainOverflow
+		if len(c.overflow) < cap(c.send) {
+			c.overflow = append(c.overflow, out)
+			if !c.draining {
+				c.draining = true
+				go c.drainOverflow()
+			}
+			return true
+		}
+	}
+
+	// Disconnect, the write pump still writes the buffered frames before the close frame
+	out.drop()
+	c.reportDrop(1 + c.dropOverflowLocked())
+	c.setLeaveReasonLocked(disconnectSlowConsumer)
+	c.disconnectLocked(c.policy.CloseCode, "slow consumer")
+	return false
+}
+
+// drainOverflow moves the frames queued by SlowConsumerBlock into the send buffer as
+// the write pump makes room, and disconnects the client when no room appears within
+// the policy's timeout. It runs without holding any lock while waiting.
+func (c *Client) drainOverflow() {
+	c.sendMu.Lock()
+	timer := time.NewTimer(c.policy.Timeout)
+	c.sendMu.Unlock()
+	defer timer.Stop()
+
+	for {
+		timedOut := false
+		select {
+		case <-c.room:
+		case <-timer.C:
+			timedOut = true
+		}
+
+		c.sendMu.Lock()
+		moved := c.flushOverflowLocked()
+		if c.sendClosed || len(c.overflow) == 0 {
+			c.draining = false
+			c.sendMu.Unlock()
+			return
+		}
+		if timedOut && !moved {
+			c.reportDrop(c.dropOverflowLocked())
+			c.draining = false
+			c.setLeaveReasonLocked(disconnectSlowConsumer)
+			c.disconnectLocked(c.policy.CloseCode, "slow consumer")
+			c.sendMu.Unlock()
+			return
+		}
+		if moved || timedOut {
+			if !timer.Stop() && !timedOut {
+				<-timer.C
+			}
+			timer.Reset(c.policy.Timeout)
+		}
+		c.sendMu.Unlock()
+	}
+}
+
+// flushOverflowLocked moves overflow frames into the send buffer while it has room
+// and reports whether any moved, the caller must hold sendMu
+func (c *Client) flushOverflowLocked() bool {
+	moved := false
+	for len(c.overflow) > 0 && !c.sendClosed {
+		select {
+		case c.send <- c.overflow[0]:
+			c.manager.metrics.observeDepth(len(c.send))
+			c.overflow[0] = outbound{}
+			c.overflow = c.overflow[1:]
+			moved = true
+		default:
+			return moved
+		}
+	}
+	return moved
+}
+
+// dropOverflowLocked discards the overflow frames and returns how many were
+// discarded, the caller must hold sendMu
+func (c *Client) dropOverflowLocked() int {
+	dropped := len(c.overflow)
+	for _, out := range c.overflow {
+		out.drop()
+	}
+	c.overflow = nil
+	return dropped
+}
+
+// signalRoom wakes drainOverflow after the write pump took a frame from the buffer
+func (c *Client) signalRoom() {
+	select {
+	case c.room <- struct{}{}:
+	default:
+	}
+}
+
+// disconnect closes the send channel, the write pump then sends a close frame with the code
+func (c *Client) disconnect(code int, reason string) {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	c.disconnectLocked(code, reason)
+}
+
+func (c *Client) disconnectLocked(code int, reason string) {
+	if !c.sendClosed {
+		c.closeCode = code
+		c.closeReason = reason
+	}
+	c.closeSendLocked()
+}
+
+// closeSend closes the send channel once
+func (c *Client) closeSend() {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	c.closeSendLocked()
+}
+
+func (c *Client) closeSendLocked() {
+	if !c.sendClosed {
+		c.sendClosed = true
+		for _, out := range c.overflow {
+			endSpan(out.span, ErrClientClosed)
+		}
+		c.overflow = nil
+		close(c.send)
+		c.signalRoom()
+	}
+}
+
+// closeMessage returns the close frame payload for the write pump
+func (c *Client) closeMessage() []byte {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	if c.closeCode == 0 {
+		return []byte{}
+	}
+	return websocket.FormatCloseMessage(c.closeCode, c.closeReason)
+}
+
+// reportDrop counts dropped frames and emits a slow consumer event, the caller must hold sendMu.
+// Events are discarded when nobody drains the SlowConsumers channel.
+func (c *Client) reportDrop(dropped int) {
+	c.dropped += uint64(dropped)
+	c.manager.metrics.dropped.Add(uint64(dropped))
+	c.manager.log().Warn("Slow consumer", c.logArgs("action", c.policy.Action, "dropped", dropped, "total_dropped", c.dropped)...)
+
+	select {
+	case c.manager.SlowConsumers <- &SlowConsumerEvent{
+		Client:       c,
+		UserID:       c.userID,
+		Action:       c.policy.Action,
+		Dropped:      dropped,
+		TotalDropped: c.dropped,
+		Time:         time.Now(),
+	}:
+	default:
+	}
+}
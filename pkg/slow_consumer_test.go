@@ -0,0 +1,126 @@
+package pkg
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newPumplessClient creates a client without read and write pumps, so its send
+// buffer only drains when the test reads from it
+func newPumplessClient(t *testing.T, m *Manager, size int, policy SlowConsumerPolicy) *Client {
+	t.Helper()
+	conns := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		conns <- conn
+	}))
+	t.Cleanup(server.Close)
+	dialTest(t, "ws"+strings.TrimPrefix(server.URL, "http"))
+	conn := <-conns
+	t.Cleanup(func() { conn.Close() })
+
+	return &Client{
+		manager: m,
+		id:      "c1",
+		conn:    conn,
+		userID:  "u1",
+		codec:   JSONCodec{},
+		send:    make(chan outbound, size),
+		room:    make(chan struct{}, 1),
+		policy:  policy,
+	}
+}
+
+func TestSlowConsumerDisconnectCountsDroppedFrame(t *testing.T) {
+	client := newPumplessClient(t, NewManager(), 2, DefaultSlowConsumerPolicy)
+	for i, want := range []bool{true, true, false} {
+		if got := client.enqueue([]byte("frame")); got != want {
+			t.Fatalf("enqueue %d = %v, want %v", i, got, want)
+		}
+	}
+	// The buffered frames are still written before the close frame
+	if client.DroppedCount() != 1 || len(client.send) != 2 || !client.sendClosed {
+		t.Fatalf("dropped %d with %d buffered, want 1 with 2 and the buffer closed", client.DroppedCount(), len(client.send))
+	}
+}
+
+func TestSlowConsumerBlockQueuesOutsideLocks(t *testing.T) {
+	m := NewManager()
+	client := newPumplessClient(t, m, 1, SlowConsumerPolicy{
+		Action:    SlowConsumerBlock,
+		CloseCode: websocket.CloseTryAgainLater,
+		Timeout:   200 * time.Millisecond,
+	})
+
+	// Enqueueing under the manager's mutex returns at once even though the buffer is full
+	start := time.Now()
+	m.mutex.Lock()
+	for i := 0; i < 3; i++ {
+		if i == 2 {
+			// Only the buffer size is queued behind the buffer
+			if client.enqueue([]byte("frame")) {
+				t.Fatal("enqueue beyond the overflow succeeded")
+			}
+			continue
+		}
+		if !client.enqueue([]byte("frame")) {
+			t.Fatalf("enqueue %d failed", i)
+		}
+	}
+	m.mutex.Unlock()
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("enqueue blocked for %v", elapsed)
+	}
+	client.sendMu.Lock()
+	closed := client.sendClosed
+	client.sendMu.Unlock()
+	if client.DroppedCount() != 2 || !closed {
+		t.Fatalf("dropped %d frames, want the new and the queued frame", client.DroppedCount())
+	}
+}
+
+func TestSlowConsumerBlockDrainsAndTimesOut(t *testing.T) {
+	client := newPumplessClient(t, NewManager(), 1, SlowConsumerPolicy{
+		Action:    SlowConsumerBlock,
+		CloseCode: websocket.CloseTryAgainLater,
+		Timeout:   200 * time.Millisecond,
+	})
+	client.enqueue([]byte("1"))
+	client.enqueue([]byte("2"))
+	if depth := client.SendBufferDepth(); depth != 2 {
+		t.Fatalf("depth %d, want 2", depth)
+	}
+
+	// Taking a frame lets the queued one into the buffer
+	<-client.send
+	client.signalRoom()
+	deadline := time.Now().Add(time.Second)
+	for client.SendBufferDepth() != 1 || len(client.send) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("queued frame did not move into the buffer")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Without room for the timeout the queued frames are dropped and the client disconnected
+	client.enqueue([]byte("3"))
+	time.Sleep(400 * time.Millisecond)
+	client.sendMu.Lock()
+	closed, code := client.sendClosed, client.closeCode
+	client.sendMu.Unlock()
+	if !closed || code != websocket.CloseTryAgainLater || client.DroppedCount() != 1 {
+		t.Fatalf("closed %v with code %d and %d dropped, want closed with 1013 and 1 dropped", closed, code, client.DroppedCount())
+	}
+	if frame := <-client.send; string(frame.frame) != "2" {
+		t.Fatalf("buffered frame %q, want 2", frame.frame)
+	}
+}
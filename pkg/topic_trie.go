@@ -0,0 +1,133 @@
+package pkg
+
+import "strings"
+
+// Topic levels are separated by "/". In subscription filters "+" matches exactly
+// one level and "#" (only valid as the last level) matches any remaining levels.
+const (
+	topicSeparator      = "/"
+	singleLevelWildcard = "+"
+	multiLevelWildcard  = "#"
+)
+
+// topicNode is one level of the subscription trie
+type topicNode struct {
+	children map[string]*topicNode
+	clients  map[*Client]bool
+}
+
+// topicTrie indexes subscription filters by level for wildcard matching
+type topicTrie struct {
+	root *topicNode
+}
+
+func newTopicTrie() *topicTrie {
+	return &topicTrie{root: newTopicNode()}
+}
+
+func newTopicNode() *topicNode {
+	return &topicNode{
+		children: make(map[string]*topicNode),
+		clients:  make(map[*Client]bool),
+	}
+}
+
+// add subscribes a client to a filter
+func (t *topicTrie) add(filter string, client *Client) {
+	node := t.root
+	for _, level := range strings.Split(filter, topicSeparator) {
+		child, ok := node.children[level]
+		if !ok {
+			child = newTopicNode()
+			node.children[level] = child
+		}
+		node = child
+	}
+	node.clients[client] = true
+}
+
+// remove unsubscribes a client from a filter and prunes empty branches
+func (t *topicTrie) remove(filter string, client *Client) {
+	removeTopicLevel(t.root, strings.Split(filter, topicSeparator), client)
+}
+
+func removeTopicLevel(node *topicNode, levels []string, client *Client) bool {
+	if len(levels) == 0 {
+		delete(node.clients, client)
+	} else if child, ok := node.children[levels[0]]; ok {
+		if removeTopicLevel(child, levels[1:], client) {
+			delete(node.children, levels[0])
+		}
+	}
+	return len(node.clients) == 0 && len(node.children) == 0
+}
+
+// match adds every client whose filter matches the topic to out
+func (t *topicTrie) match(topic string, out map[*Client]bool) {
+	matchTopicLevel(t.root, strings.Split(topic, topicSeparator), out)
+}
+
+func matchTopicLevel(node *topicNode, levels []string, out map[*Client]bool) {
+	// "#" also matches the parent level, so "game/#" receives "game"
+	if multi, ok := node.children[multiLevelWildcard]; ok {
+		for client := range multi.clients {
+			out[client] = true
+		}
+	}
+	if len(levels) == 0 {
+		for client := range node.clients {
+			out[client] = true
+		}
+		return
+	}
+	if child, ok := node.children[levels[0]]; ok {
+		matchTopicLevel(child, levels[1:], out)
+	}
+	if single, ok := node.children[singleLevelWildcard]; ok {
+		matchTopicLevel(single, levels[1:], out)
+	}
+}
+
+// validTopicFilter checks that wildcards occupy whole levels and "#" comes last
+func validTopicFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+	levels := strings.Split(filter, topicSeparator)
+	for i, level := range levels {
+		if level == multiLevelWildcard {
+			if i != len(levels)-1 {
+				return false
+			}
+			continue
+		}
+		if level != singleLevelWildcard && strings.ContainsAny(level, singleLevelWildcard+multiLevelWildcard) {
+			return false
+		}
+	}
+	return true
+}
+
+// validTopicName checks that a publish topic contains no wildcards
+func validTopicName(topic string) bool {
+	return topic != "" && !strings.ContainsAny(topic, singleLevelWildcard+multiLevelWildcard)
+}
+
+// TopicMatches reports whether a topic matches a subscription filter, brokers use it
+// to drop messages delivered by coarser transport-level patterns
+func TopicMatches(filter, topic string) bool {
+	filterLevels := strings.Split(filter, topicSeparator)
+	topicLevels := strings.Split(topic, topicSeparator)
+	for i, level := range filterLevels {
+		if level == multiLevelWildcard {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != singleLevelWildcard && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
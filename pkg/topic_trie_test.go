@@ -0,0 +1,123 @@
+package pkg
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestTopicTrieMatch(t *testing.T) {
+	trie := newTopicTrie()
+	clients := make(map[string]*Client)
+	for _, sub := range []struct{ id, filter string }{
+		{"exact", "game/room1"},
+		{"single", "game/+"},
+		{"multi", "game/#"},
+		{"all", "#"},
+		{"nested", "game/+/score"},
+		{"overlap", "game/+"},
+		{"overlap", "game/#"},
+		{"overlap", "game/room1"},
+	} {
+		if clients[sub.id] == nil {
+			clients[sub.id] = &Client{id: sub.id}
+		}
+		trie.add(sub.filter, clients[sub.id])
+	}
+
+	for _, tc := range []struct {
+		topic string
+		want  []string
+	}{
+		{"game/room1", []string{"all", "exact", "multi", "overlap", "single"}},
+		{"game/room2", []string{"all", "multi", "overlap", "single"}},
+		// "#" also matches its parent level, "+" needs exactly one level
+		{"game", []string{"all", "multi", "overlap"}},
+		{"game/room1/score", []string{"all", "multi", "nested", "overlap"}},
+		{"game/room1/chat", []string{"all", "multi", "overlap"}},
+		{"chat", []string{"all"}},
+		{"", []string{"all"}},
+	} {
+		out := make(map[*Client]bool)
+		trie.match(tc.topic, out)
+		var got []string
+		for client := range out {
+			got = append(got, client.id)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("match(%q) = %v, want %v", tc.topic, got, tc.want)
+		}
+	}
+}
+
+func TestTopicTrieRemovePrunes(t *testing.T) {
+	trie := newTopicTrie()
+	a, b := &Client{id: "a"}, &Client{id: "b"}
+	trie.add("game/+/score", a)
+	trie.add("game/+/score", b)
+	trie.add("game/#", a)
+
+	trie.remove("game/+/score", a)
+	if node := trie.root.children["game"].children["+"].children["score"]; node == nil || !node.clients[b] || node.clients[a] {
+		t.Fatal("removing one of two subscribers changed the other")
+	}
+	trie.remove("game/+/score", b)
+	if _, ok := trie.root.children["game"].children["+"]; ok {
+		t.Fatal("empty branch game/+ was not pruned")
+	}
+	if _, ok := trie.root.children["game"].children["#"]; !ok {
+		t.Fatal("sibling branch game/# was pruned")
+	}
+
+	// Removing an unknown filter leaves the trie alone
+	trie.remove("chat/room1", a)
+	trie.remove("game/#", b)
+	if _, ok := trie.root.children["game"]; !ok {
+		t.Fatal("game was pruned while a still subscribes to game/#")
+	}
+	trie.remove("game/#", a)
+	if len(trie.root.children) != 0 || len(trie.root.clients) != 0 {
+		t.Fatalf("trie is not empty after removing every filter: %d children", len(trie.root.children))
+	}
+}
+
+func TestValidTopicFilter(t *testing.T) {
+	for filter, want := range map[string]bool{
+		"game/room1":   true,
+		"game/+":       true,
+		"+/room1":      true,
+		"game/#":       true,
+		"#":            true,
+		"+":            true,
+		"game/+/#":     true,
+		"game//room1":  true,
+		"":             false,
+		"game/#/room1": false,
+		"#/game":       false,
+		"game/room+":   false,
+		"game/#room":   false,
+		"game/++":      false,
+		"game/##":      false,
+	} {
+		if got := validTopicFilter(filter); got != want {
+			t.Errorf("validTopicFilter(%q) = %v, want %v", filter, got, want)
+		}
+	}
+}
+
+func TestValidTopicName(t *testing.T) {
+	for topic, want := range map[string]bool{
+		"game/room1":  true,
+		"game":        true,
+		"game//room1": true,
+		"":            false,
+		"game/+":      false,
+		"game/#":      false,
+		"game/room+1": false,
+	} {
+		if got := validTopicName(topic); got != want {
+			t.Errorf("validTopicName(%q) = %v, want %v", topic, got, want)
+		}
+	}
+}
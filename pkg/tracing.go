@@ -0,0 +1,142 @@
+package pkg
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation scope of the manager's spans
+const tracerName = "github.com/fanqie/tank-websocket-go-server/pkg"
+
+// outbound is a frame waiting in a client's send buffer. Topic deliveries carry
+// their span so the write pump can end it once the frame is written.
+type outbound struct {
+	frame []byte
+	span  trace.Span
+	raw   bool // Payload not encoded by the codec, always written as a text frame
+}
+
+// SetTracerProvider sets the provider of connection, publish and delivery spans,
+// the global provider is used by default
+func (m *Manager) SetTracerProvider(provider trace.TracerProvider) {
+	m.tracerProvider = provider
+}
+
+// SetPropagator sets how trace context is read from upgrade requests and carried
+// in the "trace" field of envelopes and topic messages, W3C trace context by default
+func (m *Manager) SetPropagator(propagator propagation.TextMapPropagator) {
+	m.propagator = propagator
+}
+
+func (m *Manager) tracer() trace.Tracer {
+	provider := m.tracerProvider
+	if provider == nil {
+		provider = otel.GetTracerProvider()
+	}
+	return provider.Tracer(tracerName)
+}
+
+func (m *Manager) textMapPropagator() propagation.TextMapPropagator {
+	if m.propagator == nil {
+		return propagation.TraceContext{}
+	}
+	return m.propagator
+}
+
+// injectTrace returns the trace carrier of ctx, nil when it holds no span context
+func (m *Manager) injectTrace(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	m.textMapPropagator().Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+// extractTrace returns a context holding the span context of a trace carrier
+func (m *Manager) extractTrace(ctx context.Context, carrier map[string]string) context.Context {
+	if len(carrier) == 0 {
+		return ctx
+	}
+	return m.textMapPropagator().Extract(ctx, propagation.MapCarrier(carrier))
+}
+
+// startConnectSpan starts the span of a connection's authentication and upgrade,
+// continuing the trace in the request headers
+func (m *Manager) startConnectSpan(r *http.Request) (context.Context, trace.Span) {
+	ctx := m.textMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	return m.tracer().Start(ctx, "tkws.connect",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("net.peer.addr", r.RemoteAddr)))
+}
+
+// startPublishSpan starts the span of a topic publish and stores its context in
+// the message, so fan-out and delivery on every node join the same trace
+func (m *Manager) startPublishSpan(ctx context.Context, message *TopicResponse, client *Client) trace.Span {
+	attrs := []attribute.KeyValue{attribute.String("tkws.topic", message.Topic)}
+	if client != nil {
+		attrs = append(attrs, attribute.String("tkws.client_id", client.id), attribute.String("tkws.user_id", client.userID))
+	}
+	ctx, span := m.tracer().Start(ctx, "tkws.publish",
+		trace.WithSpanKind(trace.SpanKindProducer), trace.WithAttributes(attrs...))
+	message.Trace = m.injectTrace(ctx)
+	return span
+}
+
+// startFanoutSpan starts the span of a topic message's local fan-out
+func (m *Manager) startFanoutSpan(message *TopicResponse) (context.Context, trace.Span) {
+	return m.tracer().Start(m.extractTrace(context.Background(), message.Trace), "tkws.fanout",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attribute.String("tkws.topic", message.Topic), attribute.Int64("tkws.seq", int64(message.Seq))))
+}
+
+// startDeliverSpan starts the span of one client's delivery, it ends when the
+// write pump has written the frame or the frame is dropped. Deliveries outside a
+// recording fan-out, such as replays, are not traced.
+func (m *Manager) startDeliverSpan(ctx context.Context, client *Client, message *TopicResponse) trace.Span {
+	if !trace.SpanFromContext(ctx).IsRecording() {
+		return nil
+	}
+	_, span := m.tracer().Start(ctx, "tkws.deliver", trace.WithAttributes(
+		attribute.String("tkws.topic", message.Topic),
+		attribute.String("tkws.client_id", client.id),
+		attribute.String("tkws.user_id", client.userID),
+	))
+	return span
+}
+
+// startWriteSpan starts the span of a traced frame's socket write, nil for untraced frames
+func (m *Manager) startWriteSpan(out outbound) trace.Span {
+	if out.span == nil {
+		return nil
+	}
+	_, span := m.tracer().Start(trace.ContextWithSpan(context.Background(), out.span), "tkws.write",
+		trace.WithAttributes(attribute.Int("tkws.bytes", len(out.frame))))
+	return span
+}
+
+// endSpan records err on a span and ends it, nil spans are ignored
+func endSpan(span trace.Span, err error) {
+	if span == nil {
+		return
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// drop ends the span of a frame that was dropped for a slow consumer
+func (o outbound) drop() {
+	if o.span != nil {
+		o.span.SetStatus(codes.Error, "dropped by slow consumer policy")
+		o.span.End()
+	}
+}
@@ -0,0 +1,168 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// startTestManager starts a manager recording its spans and serves it over HTTP
+func startTestManager(t *testing.T) (*Manager, *tracetest.SpanRecorder, string) {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	m := NewManager()
+	m.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	m.DisableHeartbeat()
+	go m.Start()
+
+	server := httptest.NewServer(http.HandlerFunc(m.HandleConnection))
+	t.Cleanup(server.Close)
+	return m, recorder, "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func dialTest(t *testing.T, url string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// readFrame reads JSON frames until one satisfies match, other frames are skipped
+func readFrame(t *testing.T, conn *websocket.Conn, match func(frame map[string]interface{}) bool) map[string]interface{} {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		var frame map[string]interface{}
+		if json.Unmarshal(message, &frame) == nil && match(frame) {
+			return frame
+		}
+	}
+}
+
+func subscribeTest(t *testing.T, conn *websocket.Conn, topic string) {
+	t.Helper()
+	conn.WriteJSON(map[string]interface{}{"op": OpSubscribe, "id": "sub", "topic": topic})
+	readFrame(t, conn, func(frame map[string]interface{}) bool { return frame["op"] == OpSubscribed })
+}
+
+// endedSpan waits until a span with the name has ended
+func endedSpan(t *testing.T, recorder *tracetest.SpanRecorder, name string) sdktrace.ReadOnlySpan {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, span := range recorder.Ended() {
+			if span.Name() == name {
+				return span
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("span %s did not end", name)
+	return nil
+}
+
+func TestTraceSpanTree(t *testing.T) {
+	m, recorder, url := startTestManager(t)
+	conn := dialTest(t, url)
+	subscribeTest(t, conn, "game/+")
+
+	ctx, root := m.tracer().Start(context.Background(), "test")
+	if delivered, err := m.PublishTopicMessage(ctx, "game/room1", "hello"); err != nil || delivered != 1 {
+		t.Fatalf("delivered to %d clients (%v), want 1", delivered, err)
+	}
+	root.End()
+	readFrame(t, conn, func(frame map[string]interface{}) bool { return frame["data"] == "hello" })
+
+	// Each span is a child of the previous one
+	parent := root.SpanContext()
+	for _, name := range []string{"tkws.publish", "tkws.fanout", "tkws.deliver", "tkws.write"} {
+		span := endedSpan(t, recorder, name)
+		if span.Parent().SpanID() != parent.SpanID() || span.SpanContext().TraceID() != parent.TraceID() {
+			t.Fatalf("%s has parent %s, want %s", name, span.Parent().SpanID(), parent.SpanID())
+		}
+		if span.Status().Code == codes.Error {
+			t.Fatalf("%s failed: %s", name, span.Status().Description)
+		}
+		parent = span.SpanContext()
+	}
+}
+
+func TestTraceFromEnvelope(t *testing.T) {
+	m, recorder, url := startTestManager(t)
+	m.EnableClientPublish()
+	conn := dialTest(t, url)
+	subscribeTest(t, conn, "game/room1")
+
+	const (
+		traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		spanID  = "00f067aa0ba902b7"
+	)
+	conn.WriteJSON(map[string]interface{}{
+		"op":    OpPublish,
+		"topic": "game/room1",
+		"data":  "hello",
+		"trace": map[string]string{"traceparent": "00-" + traceID + "-" + spanID + "-01"},
+	})
+	frame := readFrame(t, conn, func(frame map[string]interface{}) bool { return frame["data"] == "hello" })
+
+	publish := endedSpan(t, recorder, "tkws.publish")
+	if publish.SpanContext().TraceID().String() != traceID || publish.Parent().SpanID().String() != spanID {
+		t.Fatalf("publish span has trace %s and parent %s, want %s and %s",
+			publish.SpanContext().TraceID(), publish.Parent().SpanID(), traceID, spanID)
+	}
+	if !publish.Parent().IsRemote() {
+		t.Fatal("publish span parent is not remote")
+	}
+
+	// The delivered message carries the publish span's context
+	carried, _ := frame["trace"].(map[string]interface{})
+	traceparent, _ := carried["traceparent"].(string)
+	if want := "00-" + traceID + "-" + publish.SpanContext().SpanID().String() + "-01"; traceparent != want {
+		t.Fatalf("delivered traceparent %q, want %q", traceparent, want)
+	}
+}
+
+func TestTraceDroppedFrame(t *testing.T) {
+	m, recorder, _ := startTestManager(t)
+
+	// A client without pumps keeps its single buffer slot full
+	client := newPumplessClient(t, m, 1, SlowConsumerPolicy{Action: SlowConsumerDropNewest})
+
+	ctx, fanout := m.tracer().Start(context.Background(), "tkws.fanout")
+	m.mutex.Lock()
+	queued := m.sendTopicFrame(ctx, client, make(map[string][]byte), &TopicResponse{Topic: "game/room1", Data: "first"})
+	dropped := m.sendTopicFrame(ctx, client, make(map[string][]byte), &TopicResponse{Topic: "game/room1", Data: "second"})
+	m.mutex.Unlock()
+	fanout.End()
+	if !queued || dropped {
+		t.Fatalf("queued %v and %v, want true and false", queued, dropped)
+	}
+
+	deliver := endedSpan(t, recorder, "tkws.deliver")
+	if deliver.Status().Code != codes.Error {
+		t.Fatalf("dropped deliver span has status %v, want error", deliver.Status().Code)
+	}
+	if deliver.Parent().SpanID() != trace.SpanContextFromContext(ctx).SpanID() {
+		t.Fatal("dropped deliver span is not a child of the fan-out")
+	}
+	if client.DroppedCount() != 1 {
+		t.Fatalf("dropped %d frames, want 1", client.DroppedCount())
+	}
+}
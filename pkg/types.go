@@ -1,18 +1,39 @@
 package pkg
 
 import (
+	"context"
+	"log/slog"
 	"net/http"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type TopicResponse struct {
-	Topic string `json:"topic"`
-	Data  string `json:"data"`
+	ID       string `json:"id,omitempty"` // Message ID to acknowledge when delivered with qos 1
+	Topic    string `json:"topic"`
+	Data     string `json:"data"`
+	Retained bool   `json:"retained,omitempty"` // Replayed from the retained value on subscribe
+	Seq      uint64 `json:"seq,omitempty"`      // Per-topic sequence number
+	From     string `json:"from,omitempty"`     // User ID of the publishing client, empty for server messages
+
+	Trace map[string]string `json:"trace,omitempty"` // Trace context of the publish span
 }
 
+// HeartbeatMode selects how heartbeats are sent to clients
+type HeartbeatMode string
+
+const (
+	// HeartbeatPing sends WebSocket ping control frames, answered by pongs
+	HeartbeatPing HeartbeatMode = "ping"
+	// HeartbeatJSON sends {"type":"heartbeat"} text frames for clients that
+	// cannot see control frames, such as browsers; they reply with the same message
+	HeartbeatJSON HeartbeatMode = "json"
+)
+
 // ErrorEvent represents an error event in the WebSocket service
 type ErrorEvent struct {
 	Client  *Client   `json:"-"`
@@ -39,38 +60,144 @@ type Manager struct {
 	Unregister     chan *Client
 	Subscribe      chan *Subscription
 	Unsubscribe    chan *Subscription
-	Errors         chan *ErrorEvent      // Error event channel
-	ConnEvents     chan *ConnectionEvent // Connection event channel
+	Errors         chan *ErrorEvent        // Error events, discarded when full
+	ConnEvents     chan *ConnectionEvent   // Connection event channel
+	SlowConsumers  chan *SlowConsumerEvent // Dropped frame events, discarded when full
+	publishes      chan *publication       // Client publishes, ordered with their subscriptions
 	mutex          sync.Mutex
-	Topics         map[string]map[*Client]bool
-	httpServer     *http.Server  // For closing HTTP server
-	shutdown       chan struct{} // Channel for shutdown notification
-	isRunning      bool          // Server running status
+	Topics         map[string]map[*Client]bool // Subscribers by topic filter
+	topicTree      *topicTrie                  // Wildcard index over Topics
+	users          map[string]map[*Client]bool // Connections by user ID
+	httpServer     *http.Server                // For closing HTTP server
+	shutdown       chan struct{}               // Channel for shutdown notification
+	isRunning      bool                        // Server running status
 
 	// Heartbeat configuration
 	enableHeartbeat   bool
 	heartbeatInterval time.Duration
 	heartbeatTimeout  time.Duration
+	heartbeatMode     HeartbeatMode
 
 	// Authentication
-	authEnabled bool
-	authFunc    func(r *http.Request) bool
+	authenticator Authenticator
+	authorizer    Authorizer
+
+	// Logging configuration
+	debug           bool         // 是否启用调试日志
+	logger          *slog.Logger // Defaults to slog.Default()
+	payloadLogLimit int          // Payload bytes in debug records, 0 redacts payloads
+
+	// Protocol configuration
+	legacyProtocol bool                   // Accept "sub:"/"unsub:" prefixes and plain-text broadcasts
+	clientPublish  bool                   // Accept publish commands from clients
+	legacyPublish  bool                   // Accept legacy plain-text broadcasts, until DisableClientPublish
+	handlers       map[string]HandlerFunc // Message handlers by type
+	handlerTimeout time.Duration          // Deadline of handler contexts, zero for none
+	handlerLimit   int                    // Concurrent handlers per client, zero for no limit
+	callTimeout    time.Duration          // Default timeout of server-to-client calls
+
+	// Retained messages
+	retained      map[string]*TopicResponse // Last message by topic
+	retainFilters map[string]bool           // Topic filters whose messages are retained
+
+	// Topic history
+	topicSeq    map[string]uint64        // Last sequence number by topic
+	history     map[string]*topicHistory // Recent messages by topic
+	historySize int                      // Messages kept per topic, 0 disables history
+
+	// Session resumption
+	sessionResume    bool
+	sessionGrace     time.Duration       // How long a detached session can be resumed
+	sessionQueueSize int                 // Topic messages queued per detached session
+	sessions         map[string]*session // Detached sessions by token
+
+	// At-least-once delivery
+	ackDelivery   bool
+	ackTimeout    time.Duration // Redelivery timeout for unacknowledged messages
+	ackMaxRetries int           // Redeliveries before giving up
+
+	// Send buffering
+	sendBufferSize     int
+	slowConsumerPolicy SlowConsumerPolicy
 
-	// Debug configuration
-	debug bool // 是否启用调试日志
+	// Cluster
+	nodeID   string
+	broker   Broker
+	interest map[string]int // Local subscribers and detached sessions by topic filter
+	presence Presence
+	seen     map[string]bool
+	seenIDs  []string // Recently relayed broker message IDs, oldest first
+
+	// Presence and broker updates applied in order outside the mutex, guarded by clusterMu
+	clusterMu   sync.Mutex
+	clusterOps  []func()
+	clusterBusy bool // Whether applyCluster is running
+
+	// Codecs negotiated via Sec-WebSocket-Protocol
+	codecs     map[string]Codec
+	codecNames []string // Registration order, used as server preference
+
+	metrics *metrics
+
+	tracerProvider trace.TracerProvider
+	propagator     propagation.TextMapPropagator
 }
 
 // Client represents a WebSocket connection
 type Client struct {
-	manager *Manager
-	conn    *websocket.Conn
-	send    chan []byte
-	userID  string
-	topics  map[string]bool
+	manager     *Manager
+	id          string // Unique connection ID
+	conn        *websocket.Conn
+	send        chan outbound
+	userID      string
+	topics      map[string]bool
+	codec       Codec
+	qos         map[string]int             // QoS level by subscribed topic filter
+	pending     map[string]*pendingMessage // Unacknowledged QoS 1 messages by ID
+	replaying   int                        // Broker history replays still being fetched
+	held        []*TopicResponse           // Live messages held back until the replays are queued
+	connectedAt time.Time
+	ctx         context.Context // Cancelled when the client disconnects
+	cancel      context.CancelFunc
+
+	handlerSlots chan struct{} // Holds a token per running handler, nil for no limit
+
+	// Pending server-to-client calls by ID, guarded by callMu
+	callMu sync.Mutex
+	calls  map[string]chan *Envelope
+
+	// Identity, guarded by authMu
+	authMu    sync.Mutex
+	principal *Principal
+	expiry    *time.Timer // Closes the connection when the principal expires
+
+	// Send buffer state, guarded by sendMu
+	sendMu      sync.Mutex
+	sendClosed  bool
+	policy      SlowConsumerPolicy
+	dropped     uint64
+	overflow    []outbound    // Frames queued behind a full buffer by SlowConsumerBlock
+	draining    bool          // Whether drainOverflow is running
+	room        chan struct{} // Signalled when the write pump takes a frame
+	closeCode   int
+	closeReason string
+	leaveReason string // Disconnect reason reported in metrics
+
+	sessionToken string   // Token for resuming this client's session
+	resumed      *session // Session to restore on register
+}
+
+// publication is a topic message published by a client or through PublishTopicMessage
+type publication struct {
+	client  *Client
+	message *TopicResponse
+	exclude bool     // Skip the publishing client
+	result  chan int // Receives the number of local recipients, if set
 }
 
 // Subscription represents a topic subscription by a client
 type Subscription struct {
 	client *Client
 	topic  string
+	cmd    *Envelope // Originating command, nil for legacy subscriptions
 }
@@ -0,0 +1,75 @@
+package pkg
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// ID returns the unique connection ID of the client
+func (c *Client) ID() string {
+	return c.id
+}
+
+// UserID returns the user ID the client connected as
+func (c *Client) UserID() string {
+	return c.userID
+}
+
+// SendToUser sends a message to every connection of a user across the cluster
+// and returns how many local connections received it
+func (m *Manager) SendToUser(userID string, message []byte) int {
+	if m.debug {
+		m.debugLog("Sending message to user", append([]any{"user_id", userID}, m.payloadArgs(message)...)...)
+	}
+
+	m.publishToBroker(&BrokerMessage{Kind: BrokerUser, UserID: userID, Data: message})
+	return m.sendToUserLocal(userID, message)
+}
+
+// sendToUserLocal sends a message to the user's connections on this node
+func (m *Manager) sendToUserLocal(userID string, message []byte) int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delivered := 0
+	for client := range m.users[userID] {
+		if client.enqueueRaw(message) {
+			delivered++
+		}
+	}
+	return delivered
+}
+
+// GetUserConnectionCount gets the number of connections of a user
+func (m *Manager) GetUserConnectionCount(userID string) int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return len(m.users[userID])
+}
+
+// addUserClient indexes a client under its user ID, the caller must hold the mutex
+func (m *Manager) addUserClient(client *Client) {
+	if _, ok := m.users[client.userID]; !ok {
+		m.users[client.userID] = make(map[*Client]bool)
+	}
+	m.users[client.userID][client] = true
+}
+
+// removeUserClient drops a client from the user index, the caller must hold the mutex
+func (m *Manager) removeUserClient(client *Client) {
+	if clients, ok := m.users[client.userID]; ok {
+		delete(clients, client)
+		if len(clients) == 0 {
+			delete(m.users, client.userID)
+		}
+	}
+}
+
+// randomID returns a random hex string of n bytes
+func randomID(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}